@@ -0,0 +1,519 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// addrList holds the network addresses of a resolver,
+// failing over to the next address when dialing fails.
+type addrList struct {
+	sync.Mutex
+
+	addrs []string
+	index int
+	fails int
+
+	// weights, if set, select addresses at random, in proportion to their weight,
+	// among those that have not failed.
+	weights []int
+	down    []bool
+	rand    randFunc
+
+	// latency, if set, selects the fastest address among those that have not failed.
+	latency bool
+	rtts    map[string]time.Duration
+
+	// lookup, if set, resolves addresses on first use,
+	// and again once every address has failed.
+	// Concurrent callers share the pending lookup, which runs without holding the mutex.
+	lookup  func(ctx context.Context) ([]string, error)
+	pending *lookupCall
+
+	// backoff, if set, is the initial delay between dial attempts,
+	// doubling up to maxBackoff, with jitter.
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// A lookupCall is a pending lookup of addresses.
+type lookupCall struct {
+	done chan struct{}
+	err  error
+}
+
+func (l *addrList) get(ctx context.Context) (string, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	for len(l.addrs) == 0 {
+		if l.lookup == nil {
+			return "", errNoAddresses
+		}
+		l.Unlock()
+		err := l.resolve(ctx)
+		l.Lock()
+		if err != nil {
+			return "", err
+		}
+	}
+	if l.latency {
+		return l.addrs[l.fastest()], nil
+	}
+	if l.weights != nil {
+		return l.addrs[l.pick()], nil
+	}
+	return l.addrs[l.index], nil
+}
+
+// resolve looks up the addresses;
+// concurrent callers wait for a single lookup.
+func (l *addrList) resolve(ctx context.Context) error {
+	l.Lock()
+	call := l.pending
+	if call == nil {
+		call = &lookupCall{done: make(chan struct{})}
+		l.pending = call
+		l.Unlock()
+
+		addrs, err := l.lookup(ctx)
+		if err == nil && len(addrs) == 0 {
+			err = errNoAddresses
+		}
+
+		l.Lock()
+		if err == nil {
+			l.addrs = addrs
+			l.index = 0
+			l.fails = 0
+			if l.weights == nil {
+				l.down = nil
+			}
+		}
+		call.err = err
+		l.pending = nil
+		l.Unlock()
+		close(call.done)
+		return err
+	}
+	l.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *addrList) fastest() int {
+	if len(l.down) != len(l.addrs) {
+		l.down = make([]bool, len(l.addrs))
+	}
+	for {
+		// unmeasured addresses are tried first
+		best := -1
+		for i, a := range l.addrs {
+			if !l.down[i] && (best < 0 || l.rtts[a] < l.rtts[l.addrs[best]]) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			return best
+		}
+		// all addresses failed, try them again
+		for i := range l.down {
+			l.down[i] = false
+		}
+	}
+}
+
+// observe updates the moving average of the latency of addr.
+func (l *addrList) observe(addr string, d time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if d <= 0 {
+		d = 1
+	}
+	if l.rtts == nil {
+		l.rtts = make(map[string]time.Duration)
+	}
+	if avg, ok := l.rtts[addr]; ok {
+		d = avg + (d-avg)/4
+	}
+	l.rtts[addr] = d
+}
+
+// stats returns the stats of each address.
+func (l *addrList) stats() []UpstreamStats {
+	l.Lock()
+	defer l.Unlock()
+	stats := make([]UpstreamStats, len(l.addrs))
+	for i, a := range l.addrs {
+		stats[i] = UpstreamStats{Addr: a, Latency: l.rtts[a]}
+		if i < len(l.down) {
+			stats[i].Down = l.down[i]
+		}
+	}
+	return stats
+}
+
+// An UpstreamStats describes a network address of a resolver.
+type UpstreamStats struct {
+	Addr    string
+	Latency time.Duration // moving average of the round-trip time, zero if unknown
+	Down    bool          // avoided after failing, with weighted or latency-aware selection
+}
+
+func (l *addrList) pick() int {
+	total := 0
+	for i, w := range l.weights {
+		if !l.down[i] {
+			total += w
+		}
+	}
+	if total == 0 {
+		// all addresses failed, try them again
+		for i, w := range l.weights {
+			l.down[i] = false
+			total += w
+		}
+	}
+
+	n := l.rand.intn(total)
+	for i, w := range l.weights {
+		if l.down[i] {
+			continue
+		}
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	panic("unreachable")
+}
+
+func (l *addrList) failed(addr string) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.weights != nil || l.latency {
+		all := len(l.down) == len(l.addrs)
+		for i, a := range l.addrs {
+			if a == addr && i < len(l.down) {
+				l.down[i] = true
+			}
+			if i < len(l.down) && !l.down[i] {
+				all = false
+			}
+		}
+		if l.lookup != nil && all {
+			// all addresses failed, resolve them again
+			l.addrs = nil
+		}
+		return
+	}
+	if l.index < len(l.addrs) && l.addrs[l.index] == addr {
+		l.index = (l.index + 1) % len(l.addrs)
+		l.fails++
+		if l.lookup != nil && l.fails >= len(l.addrs) {
+			// all addresses failed, resolve them again
+			l.addrs = nil
+		}
+	}
+}
+
+func (l *addrList) succeeded() {
+	l.Lock()
+	defer l.Unlock()
+	l.fails = 0
+}
+
+// dial connects to an address, failing over to the next ones,
+// until every address has been tried.
+// If network requests an address family, like "tcp4", only addresses of that family are tried.
+func (l *addrList) dial(ctx context.Context, dial DialFunc, network string) (net.Conn, string, error) {
+	var errs DialError
+	for i := 0; ; i++ {
+		addr, err := l.get(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		if !inFamily(network, addr) {
+			// skip addresses of other families, without failing them
+			addr = l.nextInFamily(network, addr, &errs)
+			if addr == "" && len(errs.Errors) == 0 {
+				return nil, "", fmt.Errorf("%w for network %s", errNoAddresses, network)
+			}
+			if addr == "" {
+				return nil, "", &errs
+			}
+		}
+		for _, e := range errs.Errors {
+			if e.Addr == addr {
+				return nil, "", &errs
+			}
+		}
+		if i > 0 && l.backoff > 0 {
+			if err := l.wait(ctx, i); err != nil {
+				return nil, "", &errs
+			}
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err == nil {
+			l.succeeded()
+			return conn, addr, nil
+		}
+		l.failed(addr)
+		errs.Errors = append(errs.Errors, AddrError{Addr: addr, Err: err})
+		if ctx.Err() != nil {
+			return nil, "", &errs
+		}
+	}
+}
+
+// nextInFamily returns the address after addr that is in the family requested by network,
+// and hasn't been tried yet, or an empty string.
+func (l *addrList) nextInFamily(network, addr string, tried *DialError) string {
+	l.Lock()
+	defer l.Unlock()
+
+	start := 0
+	for i, a := range l.addrs {
+		if a == addr {
+			start = i
+		}
+	}
+next:
+	for i := range l.addrs {
+		a := l.addrs[(start+i)%len(l.addrs)]
+		if !inFamily(network, a) {
+			continue
+		}
+		for _, e := range tried.Errors {
+			if e.Addr == a {
+				continue next
+			}
+		}
+		return a
+	}
+	return ""
+}
+
+// inFamily reports whether addr is in the address family requested by network, if any.
+func inFamily(network, addr string) bool {
+	var want4 bool
+	switch network {
+	case "tcp4", "udp4":
+		want4 = true
+	case "tcp6", "udp6":
+	default:
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return true
+	}
+	return ap.Addr().Unmap().Is4() == want4
+}
+
+// measure wraps conn to observe the latency of exchanges with addr.
+func (l *addrList) measure(conn net.Conn, addr string) net.Conn {
+	return &latencyConn{Conn: conn, addrs: l, addr: addr}
+}
+
+// latencyConn times each write until the next read.
+type latencyConn struct {
+	net.Conn
+	addrs *addrList
+	addr  string
+	start atomic.Int64
+}
+
+func (c *latencyConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err == nil {
+		c.start.CompareAndSwap(0, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *latencyConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if start := c.start.Swap(0); start != 0 {
+			c.addrs.observe(c.addr, time.Duration(time.Now().UnixNano()-start))
+		}
+	}
+	return n, err
+}
+
+// wait waits before the given dial attempt, bounded by ctx.
+func (l *addrList) wait(ctx context.Context, attempt int) error {
+	d := l.backoff
+	for i := 1; i < attempt && d < l.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > l.maxBackoff {
+		d = l.maxBackoff
+	}
+	// jitter in [d/2, d)
+	d = d/2 + time.Duration(l.rand.float64()*float64(d/2))
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *addrList) setBackoff(backoff, max time.Duration) {
+	if max < backoff {
+		max = backoff
+	}
+	l.backoff = backoff
+	l.maxBackoff = max
+	if l.rand == nil {
+		l.rand = cryptoRand
+	}
+}
+
+func (l *addrList) setWeights(weights []int) {
+	if weights == nil {
+		return
+	}
+	l.weights = weights
+	l.down = make([]bool, len(weights))
+	if l.rand == nil {
+		l.rand = cryptoRand
+	}
+}
+
+// weightedAddrs splits weighted addresses into parallel slices,
+// ignoring addresses with non-positive weights.
+func weightedAddrs(weighted map[string]int) (addrs []string, weights []int) {
+	addrs = make([]string, 0, len(weighted))
+	for a, w := range weighted {
+		if w > 0 {
+			addrs = append(addrs, a)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+	sort.Strings(addrs)
+	weights = make([]int, len(addrs))
+	for i, a := range addrs {
+		weights[i] = weighted[a]
+	}
+	return addrs, weights
+}
+
+var errNoAddresses = errors.New("dns: no server addresses")
+
+// A DialError is returned when connecting to every address of a resolver fails.
+type DialError struct {
+	Errors []AddrError
+}
+
+// An AddrError is the error connecting to an address of a resolver.
+type AddrError struct {
+	Addr string
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	var buf strings.Builder
+	buf.WriteString("dns: all addresses failed")
+	for i, e := range e.Errors {
+		if i == 0 {
+			buf.WriteString(": ")
+		} else {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(e.Addr)
+		buf.WriteString(": ")
+		buf.WriteString(e.Err.Error())
+	}
+	return buf.String()
+}
+
+// Unwrap returns the last error.
+func (e *DialError) Unwrap() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e.Errors[len(e.Errors)-1].Err
+}
+
+// Is reports whether any of the errors matches target.
+func (e *DialError) Is(target error) bool {
+	for _, e := range e.Errors {
+		if errors.Is(e.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupAddrs(ctx context.Context, host, port string) ([]string, error) {
+	ips, err := OpportunisticResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return addrs, nil
+}
+
+// normalizeAddrs accepts IP addresses, with or without brackets,
+// and network addresses of the form "IP:port",
+// and returns network addresses, using port if none is given.
+func normalizeAddrs(addrs []string, port string) ([]string, error) {
+	res := make([]string, len(addrs))
+	for i, a := range addrs {
+		host, p, err := net.SplitHostPort(a)
+		if err != nil {
+			host, p = a, port
+			if len(a) > 2 && a[0] == '[' && a[len(a)-1] == ']' {
+				host = a[1 : len(a)-1]
+			}
+		}
+		ip, err := netip.ParseAddr(host)
+		if err != nil || !validZone(ip.Zone()) {
+			return nil, fmt.Errorf("dns: invalid address %q", a)
+		}
+		if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+			return nil, fmt.Errorf("dns: invalid port in address %q", a)
+		}
+		// the zone, like "eth0" in "fe80::1%eth0", is kept for the dialer
+		res[i] = net.JoinHostPort(host, p)
+	}
+	return res, nil
+}
+
+// validZone reports whether zone is empty, or an interface name or index.
+func validZone(zone string) bool {
+	for i := 0; i < len(zone); i++ {
+		c := zone[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
@@ -4,11 +4,22 @@ import (
 	"context"
 	"math"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 // NewCachingResolver creates a caching [net.Resolver] that uses parent to resolve names.
+//
+// Like any [net.Resolver] that prefers the Go resolver, it expands names
+// with the search list and ndots option of /etc/resolv.conf, before queries reach the cache;
+// these can't be overridden per resolver.
+// Rooted names, like "example.com.", are never expanded,
+// and neither are names looked up with [LookupIPAddrTTL], [LookupSOA] or [Warm]:
+// use these to avoid expansion.
 func NewCachingResolver(parent *net.Resolver, options ...CacheOption) *net.Resolver {
 	if parent == nil {
 		parent = &net.Resolver{}
@@ -16,25 +27,50 @@ func NewCachingResolver(parent *net.Resolver, options ...CacheOption) *net.Resol
 
 	return &net.Resolver{
 		PreferGo:     true,
-		StrictErrors: parent.StrictErrors,
+		StrictErrors: strictErrors(options, parent.StrictErrors),
 		Dial:         NewCachingDialer(parent.Dial, options...),
 	}
 }
 
 // NewCachingDialer adds caching to a [net.Resolver.Dial] function.
 func NewCachingDialer(parent DialFunc, options ...CacheOption) DialFunc {
-	var cache = cache{dial: parent, negative: true}
+	cache := newCache(options...)
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn := &dnsConn{maxQueue: cache.maxQueue}
+		conn.roundTrip = cachingRoundTrip(cache, parent, network, address, noCache(ctx), lifetime(ctx))
+		return conn, nil
+	}
+}
+
+func newCache(options ...CacheOption) *cache {
+	var cache = &cache{negative: true, positive: true}
 	for _, o := range options {
-		o.apply(&cache)
+		o.apply(cache)
+	}
+	if cache.shared != nil {
+		if c := cache.shared.cache.Load(); c != nil {
+			return c
+		}
 	}
 	if cache.maxEntries == 0 {
 		cache.maxEntries = DefaultMaxCacheEntries
 	}
-	return func(ctx context.Context, network, address string) (net.Conn, error) {
-		conn := &dnsConn{}
-		conn.roundTrip = cachingRoundTrip(&cache, network, address)
-		return conn, nil
+	if cache.rand == nil {
+		cache.rand = cryptoRand
+	}
+	if cache.maxQueries > 0 {
+		cache.sem = make(chan struct{}, cache.maxQueries)
+	}
+	if cache.shared != nil {
+		// the first resolver to use the cache creates it
+		if !cache.shared.cache.CompareAndSwap(nil, cache) {
+			return cache.shared.cache.Load()
+		}
+	}
+	if cache.handle != nil {
+		cache.handle.cache.Store(cache)
 	}
+	return cache
 }
 
 const DefaultMaxCacheEntries = 150
@@ -47,41 +83,362 @@ type CacheOption interface {
 type maxEntriesOption int
 type maxTTLOption time.Duration
 type minTTLOption time.Duration
+type minNegativeTTLOption time.Duration
 type negativeCacheOption bool
-
-func (o maxEntriesOption) apply(c *cache)    { c.maxEntries = int(o) }
-func (o maxTTLOption) apply(c *cache)        { c.maxTTL = time.Duration(o) }
-func (o minTTLOption) apply(c *cache)        { c.minTTL = time.Duration(o) }
-func (o negativeCacheOption) apply(c *cache) { c.negative = bool(o) }
+type positiveCacheOption bool
+type evictionOption Eviction
+type onCacheHitOption func(string, CacheStatus)
+type ttlJitterOption float64
+type cacheRandOption func() uint64
+type ednsBufSizeOption uint16
+type cacheTypesOption []dnsmessage.Type
+type cacheClassesOption []dnsmessage.Class
+type maxQueriesOption int
+type cacheKeyOption func(string) string
+type typeTTLsOption map[dnsmessage.Type]TTLBounds
+type cacheHandleOption struct{ *Cache }
+type cacheGraceOption time.Duration
+type sharedCacheOption struct{ *Cache }
+type cdOption struct{}
+type strictErrorsOption bool
+type onResponseOption func(query, response []byte) []byte
+type cacheOriginalOption struct{}
+type forceTCPOption struct{}
+type maxQueueOption int
+
+func (o maxEntriesOption) apply(c *cache)     { c.maxEntries = int(o) }
+func (o maxTTLOption) apply(c *cache)         { c.maxTTL = time.Duration(o) }
+func (o minTTLOption) apply(c *cache)         { c.minTTL = time.Duration(o) }
+func (o minNegativeTTLOption) apply(c *cache) { c.minNegTTL = time.Duration(o) }
+func (o negativeCacheOption) apply(c *cache)  { c.negative = bool(o) }
+func (o positiveCacheOption) apply(c *cache)  { c.positive = bool(o) }
+func (o evictionOption) apply(c *cache)       { c.eviction = Eviction(o) }
+func (o onCacheHitOption) apply(c *cache)     { c.onHit = o }
+func (o ttlJitterOption) apply(c *cache)      { c.jitter = float64(o) }
+func (o cacheRandOption) apply(c *cache)      { c.rand = randFunc(o) }
+func (o ednsBufSizeOption) apply(c *cache)    { c.ednsBufSize = uint16(o) }
+func (o cacheTypesOption) apply(c *cache)     { c.types = o }
+func (o cacheClassesOption) apply(c *cache)   { c.classes = o }
+func (o maxQueriesOption) apply(c *cache)     { c.maxQueries = int(o) }
+func (o cacheKeyOption) apply(c *cache)       { c.keyFunc = o }
+func (o typeTTLsOption) apply(c *cache)       { c.typeTTLs = o }
+func (o cacheHandleOption) apply(c *cache)    { c.handle = o.Cache }
+func (o cacheGraceOption) apply(c *cache)     { c.grace = time.Duration(o) }
+func (o sharedCacheOption) apply(c *cache)    { c.shared = o.Cache }
+func (o cdOption) apply(c *cache)             { c.cd = true }
+func (o strictErrorsOption) apply(c *cache)   {}
+func (o onResponseOption) apply(c *cache)     { c.onResponse = o }
+func (o cacheOriginalOption) apply(c *cache)  { c.original = true }
+func (o forceTCPOption) apply(c *cache)       { c.tcp = true }
+func (o maxQueueOption) apply(c *cache)       { c.maxQueue = int(o) }
 
 // MaxCacheEntries sets the maximum number of entries to cache.
 // If zero, [DefaultMaxCacheEntries] is used; negative means no limit.
 func MaxCacheEntries(n int) CacheOption { return maxEntriesOption(n) }
 
+// MaxConcurrentQueries limits the number of concurrent queries sent upstream on cache misses.
+// Excess queries wait for their turn, or until their context is done.
+// If zero or negative, there is no limit.
+func MaxConcurrentQueries(n int) CacheOption { return maxQueriesOption(n) }
+
 // MaxCacheTTL sets the maximum time-to-live for entries in the cache.
 func MaxCacheTTL(d time.Duration) CacheOption { return maxTTLOption(d) }
 
 // MinCacheTTL sets the minimum time-to-live for entries in the cache.
 func MinCacheTTL(d time.Duration) CacheOption { return minTTLOption(d) }
 
-// NegativeCache sets whether to cache negative responses.
+// MinNegativeCacheTTL sets the minimum time-to-live for negative responses in the cache:
+// name errors, and responses with no answers.
+// If set, it replaces [MinCacheTTL] for negative responses; [MaxCacheTTL] still applies.
+func MinNegativeCacheTTL(d time.Duration) CacheOption { return minNegativeTTLOption(d) }
+
+// TTLJitter sets the maximum fraction (between 0 and 1) of the time-to-live
+// randomly subtracted from entries in the cache, to spread out their expiry.
+// Jitter only ever shortens the time-to-live.
+func TTLJitter(fraction float64) CacheOption { return ttlJitterOption(fraction) }
+
+// CacheRand sets the source of randomness used by the cache for [TTLJitter], see [RandSource].
+func CacheRand(f RandSource) CacheOption { return cacheRandOption(f) }
+
+// CacheTypes restricts caching to answers for questions of the given types.
+// By default, answers of all types are cached.
+func CacheTypes(types ...dnsmessage.Type) CacheOption { return cacheTypesOption(types) }
+
+// CacheClasses restricts caching to answers for questions of the given classes,
+// like [dnsmessage.ClassINET], so that diagnostic queries, like CHAOS class "version.bind", aren't cached.
+// By default, answers of all classes are cached.
+func CacheClasses(classes ...dnsmessage.Class) CacheOption { return cacheClassesOption(classes) }
+
+// CacheTTLByType sets time-to-live bounds for answers to questions of the given types.
+// Bounds set for a type override [MinCacheTTL], [MinNegativeCacheTTL], and [MaxCacheTTL].
+func CacheTTLByType(bounds map[dnsmessage.Type]TTLBounds) CacheOption { return typeTTLsOption(bounds) }
+
+// TTLBounds are the minimum and maximum time-to-live of entries in the cache.
+// Zero values leave the corresponding global bound unchanged.
+type TTLBounds struct {
+	Min, Max time.Duration
+}
+
+// CacheKeyFunc sets a function that derives cache keys from DNS query messages.
+// Queries with the same key share cache entries; an empty key disables caching for the query.
+// By default, the key is the query without its message ID, and with question names case folded.
+func CacheKeyFunc(f func(query string) string) CacheOption { return cacheKeyOption(f) }
+
+// CacheGrace sets a grace window during which expired answers are still served from the cache,
+// while they're refreshed in the background.
+// This smooths over expiry for frequently queried names.
+func CacheGrace(d time.Duration) CacheOption {
+	if d < 0 {
+		d = 0
+	}
+	return cacheGraceOption(d)
+}
+
+// NegativeCache sets whether to cache negative responses (NXDOMAIN and NODATA).
 func NegativeCache(b bool) CacheOption { return negativeCacheOption(b) }
 
-type cache struct {
-	sync.RWMutex
+// PositiveCache sets whether to cache positive responses, those with answers.
+// Disabling it caches only negative responses (NXDOMAIN and NODATA),
+// which dampens repeated failures, while answers are always fresh.
+func PositiveCache(b bool) CacheOption { return positiveCacheOption(b) }
+
+// EDNSBufSize rewrites outgoing queries to advertise the given EDNS UDP payload size,
+// adding an EDNS OPT record if needed.
+// If zero, [DefaultEDNSBufSize] is used.
+// Only queries that go through the cache are rewritten;
+// for plain resolvers without a cache, use [PlainEDNSBufSize].
+func EDNSBufSize(size uint16) CacheOption {
+	if size == 0 {
+		size = DefaultEDNSBufSize
+	}
+	return ednsBufSizeOption(size)
+}
+
+// CheckingDisabled rewrites outgoing queries to set the Checking Disabled (CD) bit,
+// so validating resolvers return answers that fail DNSSEC validation, instead of SERVFAIL.
+// This is useful for debugging.
+// Only queries that go through the cache are rewritten;
+// for plain resolvers without a cache, use [PlainCheckingDisabled].
+func CheckingDisabled() CacheOption { return cdOption{} }
+
+// StrictErrors sets [net.Resolver.StrictErrors] on the caching resolver.
+// By default, it is copied from the parent resolver.
+//
+// With strict errors, a lookup fails if any of its queries fails with a temporary error,
+// like a timeout or SERVFAIL; otherwise, partial results are returned.
+// For instance, LookupIPAddr returns the IPv4 addresses of a name,
+// even if the query for its IPv6 addresses timed out.
+func StrictErrors(b bool) CacheOption { return strictErrorsOption(b) }
+
+// strictErrors returns the last StrictErrors option, or def.
+func strictErrors(options []CacheOption, def bool) bool {
+	for _, o := range options {
+		if s, ok := o.(strictErrorsOption); ok {
+			def = bool(s)
+		}
+	}
+	return def
+}
+
+// withMaxQueue returns options, with one that bounds the query queue of caching connections, if size is set.
+func withMaxQueue(options []CacheOption, size int) []CacheOption {
+	if size == 0 {
+		return options
+	}
+	return append(options[:len(options):len(options)], maxQueueOption(size))
+}
+
+// OnResponse sets a function that rewrites responses from upstream before they're cached and returned,
+// like removing AAAA records, or blocking names by answering 0.0.0.0.
+// It receives the query and the response, and returns the response to use.
+// Rewritten responses that are malformed, or don't answer the query, are replaced by the original.
+func OnResponse(f func(query, response []byte) []byte) CacheOption { return onResponseOption(f) }
+
+// CacheOriginalResponses caches the responses from upstream before they're rewritten with [OnResponse].
+// Answers from the cache are then rewritten each time, so the rewrite can change without flushing the cache.
+func CacheOriginalResponses() CacheOption { return cacheOriginalOption{} }
+
+// ForceTCP sends queries to the parent resolver over TCP, even when UDP is requested,
+// framing messages with their length, which avoids fragmentation and off-path spoofing of UDP.
+// It changes the network passed to the parent's Dial function;
+// resolvers that choose their own transport have their own options, like [PlainForceTCP].
+func ForceTCP() CacheOption { return forceTCPOption{} }
+
+// EvictionPolicy sets the policy used to evict entries from a full cache.
+// The default is [RandomSample].
+func EvictionPolicy(e Eviction) CacheOption { return evictionOption(e) }
+
+// An Eviction is a cache eviction policy.
+type Eviction int
+
+const (
+	// RandomSample evicts an entry from a small sample of the cache.
+	// It is the cheapest policy.
+	RandomSample Eviction = iota
+
+	// LRU evicts the least recently used entry from a small sample of the cache.
+	// This approximates LRU, but tracking accesses does not require exclusive locking.
+	LRU
+)
+
+// OnCacheHit sets a function that is called for every query,
+// with the queried name, and whether the answer came from the cache.
+func OnCacheHit(f func(question string, status CacheStatus)) CacheOption {
+	return onCacheHitOption(f)
+}
+
+// A CacheStatus reports whether an answer came from the cache.
+type CacheStatus int
+
+const (
+	CacheMiss             CacheStatus = iota // the answer came from upstream
+	CacheHit                                 // a positive answer came from the cache
+	CacheNegativeHit                         // a negative answer came from the cache
+	CacheStaleHit                            // a positive answer past its expiry came from the cache, see [CacheGrace]
+	CacheStaleNegativeHit                    // a negative answer past its expiry came from the cache
+)
+
+// CacheHandle binds h to the cache, so that it can be inspected.
+func CacheHandle(h *Cache) CacheOption { return cacheHandleOption{h} }
+
+// SharedCache makes the resolver use the cache c, shared with other resolvers,
+// so that answers obtained through one resolver are used by the others.
+// If c was not created with [NewCache], the first resolver to use it creates it,
+// and its options apply to all of them; otherwise, other options are ignored.
+func SharedCache(c *Cache) CacheOption { return sharedCacheOption{c} }
+
+// A Cache is a handle to the cache of a resolver, see [CacheHandle] and [SharedCache].
+type Cache struct {
+	cache atomic.Pointer[cache]
+}
+
+// NewCache creates a cache with the given options,
+// that can be shared by resolvers, see [SharedCache].
+func NewCache(options ...CacheOption) *Cache {
+	var c Cache
+	c.cache.Store(newCache(options...))
+	return &c
+}
+
+// A CacheEntry describes an answer in the cache.
+type CacheEntry struct {
+	Question     string // the queried name
+	Type         dnsmessage.Type
+	RemainingTTL time.Duration
+}
 
-	dial    DialFunc
-	entries map[string]cacheEntry
+// Entries returns a snapshot of the unexpired entries in the cache,
+// sorted by question and type.
+// Lookups are blocked only while the entries of each shard are copied.
+func (h *Cache) Entries() []CacheEntry {
+	c := h.cache.Load()
+	if c == nil {
+		return nil
+	}
+
+	type snapshot struct {
+		deadline time.Time
+		value    string
+	}
+	snapshots := make([]snapshot, 0, c.size.Load())
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.RLock()
+		for _, e := range s.entries {
+			snapshots = append(snapshots, snapshot{e.deadline, e.value})
+		}
+		s.RUnlock()
+	}
+
+	// values are responses without their ID
+	var entries []CacheEntry
+	now := time.Now()
+	for _, s := range snapshots {
+		ttl := s.deadline.Sub(now)
+		if ttl <= 0 {
+			continue
+		}
+		var p dnsmessage.Parser
+		if _, err := p.Start([]byte("\x00\x00" + s.value)); err != nil {
+			continue
+		}
+		q, err := p.Question()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, CacheEntry{
+			Question:     q.Name.String(),
+			Type:         q.Type,
+			RemainingTTL: ttl,
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Question != entries[j].Question {
+			return entries[i].Question < entries[j].Question
+		}
+		return entries[i].Type < entries[j].Type
+	})
+	return entries
+}
+
+// WithNoCache returns a copy of ctx that makes lookups bypass the cache.
+// Answers obtained with this context still replace cached ones.
+func WithNoCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, struct{}{})
+}
+
+type noCacheKey struct{}
+
+func noCache(ctx context.Context) bool {
+	return ctx.Value(noCacheKey{}) != nil
+}
+
+type cache struct {
+	shards [cacheShards]cacheShard
+	size   atomic.Int64
 
 	maxEntries int
 	maxTTL     time.Duration
 	minTTL     time.Duration
+	minNegTTL  time.Duration
 	negative   bool
+	positive   bool
+	eviction   Eviction
+	onHit      func(string, CacheStatus)
+	jitter     float64
+	rand       randFunc
+	types      []dnsmessage.Type
+	classes    []dnsmessage.Class
+	typeTTLs   map[dnsmessage.Type]TTLBounds
+	onResponse func(query, response []byte) []byte
+
+	ednsBufSize uint16
+	maxQueries  int
+	maxQueue    int
+	sem         chan struct{}
+	keyFunc     func(string) string
+	handle      *Cache
+	shared      *Cache
+	grace       time.Duration
+	cd          bool
+	original    bool
+	tcp         bool
+}
+
+// cacheShards is the number of shards of the cache,
+// so that lookups of different names don't contend for a single lock.
+const cacheShards = 16
+
+type cacheShard struct {
+	sync.RWMutex
+	entries map[string]*cacheEntry
 }
 
 type cacheEntry struct {
-	deadline time.Time
-	value    string
+	deadline   time.Time
+	value      string
+	access     atomic.Int64 // for LRU
+	refreshing atomic.Bool  // for grace
 }
 
 func (c *cache) put(req string, res string) {
@@ -91,81 +448,316 @@ func (c *cache) put(req string, res string) {
 	}
 
 	// ignore errors (if requested)
-	if nameError(res) && !c.negative {
+	if negative(res) && !c.negative {
+		return
+	}
+	if !negative(res) && !c.positive {
+		return
+	}
+
+	// ignore other types and classes (if requested)
+	if (c.types != nil || c.classes != nil) && !c.cacheable(req) {
+		return
+	}
+
+	// ignore queries without a key
+	key, _ := c.key(req)
+	if key == "" {
 		return
 	}
 
 	// ignore uncacheable/unparseable answers
-	ttl := getTTL(res)
-	if ttl <= 0 {
+	ttl, err := messageTTL(res)
+	if err != nil || ttl <= 0 {
 		return
 	}
 
 	// adjust TTL
-	if ttl < c.minTTL {
-		ttl = c.minTTL
+	minTTL, maxTTL := c.minTTL, c.maxTTL
+	if c.minNegTTL != 0 && negative(res) {
+		minTTL = c.minNegTTL
+	}
+	// per-type bounds override global ones
+	if typ, ok := questionType(req); ok && c.typeTTLs != nil {
+		if b, ok := c.typeTTLs[typ]; ok {
+			if b.Min != 0 {
+				minTTL = b.Min
+			}
+			if b.Max != 0 {
+				maxTTL = b.Max
+			}
+		}
+	}
+	if ttl < minTTL {
+		ttl = minTTL
 	}
 	// maxTTL overrides minTTL
-	if ttl > c.maxTTL && c.maxTTL != 0 {
-		ttl = c.maxTTL
+	if ttl > maxTTL && maxTTL != 0 {
+		ttl = maxTTL
+	}
+	// jitter only shortens TTL
+	if c.jitter > 0 && c.jitter <= 1 {
+		ttl -= time.Duration(float64(ttl) * c.jitter * c.rand.float64())
 	}
 
-	c.Lock()
-	defer c.Unlock()
-	if c.entries == nil {
-		c.entries = make(map[string]cacheEntry)
+	// replacing an entry doesn't grow the cache
+	i := c.shardIndex(key)
+	shard := &c.shards[i]
+	shard.RLock()
+	_, exists := shard.entries[key]
+	shard.RUnlock()
+	if !exists {
+		c.evict(i)
 	}
 
-	// do some cache evition
+	// remove message IDs
+	now := time.Now()
+	entry := &cacheEntry{
+		deadline: now.Add(ttl),
+		value:    res[2:],
+	}
+	entry.access.Store(now.UnixNano())
+
+	shard.Lock()
+	defer shard.Unlock()
+	if shard.entries == nil {
+		shard.entries = make(map[string]*cacheEntry)
+	}
+	if _, ok := shard.entries[key]; !ok {
+		c.size.Add(1)
+	}
+	shard.entries[key] = entry
+}
+
+// shardIndex returns the index of the shard for key, using FNV-1a.
+func (c *cache) shardIndex(key string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % cacheShards)
+}
+
+// evict does some cache eviction, sampling entries starting at shard start.
+// Shards are locked one at a time.
+func (c *cache) evict(start int) {
+	type sample struct {
+		shard *cacheShard
+		key   string
+		entry *cacheEntry
+	}
 	var tested, evicted int
-	for k, e := range c.entries {
-		if time.Until(e.deadline) <= 0 {
-			// delete expired entry
-			delete(c.entries, k)
-			evicted++
+	var lru, last sample
+
+	for i := 0; i < cacheShards && tested < 8; i++ {
+		s := &c.shards[(start+i)%cacheShards]
+		s.Lock()
+		for k, e := range s.entries {
+			if time.Since(e.deadline) >= c.grace {
+				// delete expired entry
+				delete(s.entries, k)
+				c.size.Add(-1)
+				evicted++
+			} else if lru.entry == nil || e.access.Load() < lru.entry.access.Load() {
+				lru = sample{s, k, e}
+			}
+			last = sample{s, k, e}
+			tested++
+
+			if tested >= 8 {
+				break
+			}
 		}
-		tested++
+		s.Unlock()
+	}
 
-		if tested < 8 {
-			continue
+	if evicted == 0 && c.maxEntries > 0 && c.size.Load() >= int64(c.maxEntries) {
+		// delete at least one entry
+		victim := last
+		if c.eviction == LRU {
+			victim = lru
 		}
-		if evicted == 0 && c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
-			// delete at least one entry
-			delete(c.entries, k)
+		if victim.entry == nil {
+			return
 		}
-		break
+		victim.shard.Lock()
+		if victim.shard.entries[victim.key] == victim.entry {
+			delete(victim.shard.entries, victim.key)
+			c.size.Add(-1)
+		}
+		victim.shard.Unlock()
 	}
+}
 
-	// remove message IDs
-	c.entries[req[2:]] = cacheEntry{
-		deadline: time.Now().Add(ttl),
-		value:    res[2:],
+func (c *cache) cacheable(req string) bool {
+	typ, class, ok := question(req)
+	if !ok {
+		return false
+	}
+	if c.types != nil {
+		found := false
+		for _, t := range c.types {
+			found = found || t == typ
+		}
+		if !found {
+			return false
+		}
+	}
+	if c.classes != nil {
+		found := false
+		for _, c := range c.classes {
+			found = found || c == class
+		}
+		if !found {
+			return false
+		}
 	}
+	return true
 }
 
-func (c *cache) get(req string) (res string) {
+// questionType returns the type of the first question of req.
+func questionType(req string) (dnsmessage.Type, bool) {
+	typ, _, ok := question(req)
+	return typ, ok
+}
+
+// question returns the type and class of the first question of req.
+func question(req string) (dnsmessage.Type, dnsmessage.Class, bool) {
+	if getUint16(req[4:]) == 0 {
+		return 0, 0, false
+	}
+	name := getNameLen(req[12:])
+	if name < 0 || 12+name+4 > len(req) {
+		return 0, 0, false
+	}
+	typ := dnsmessage.Type(getUint16(req[12+name:]))
+	class := dnsmessage.Class(getUint16(req[12+name+2:]))
+	return typ, class, true
+}
+
+// get returns the cached response to req.
+// Responses past their deadline, but within the grace window, are stale;
+// only the first get of a stale entry requests a refresh, so it's refreshed once.
+func (c *cache) get(req string) (res string, stale, refresh bool) {
 	// ignore invalid messages
 	if len(req) < 12 {
-		return ""
+		return "", false, false
 	}
 	if req[2] >= 0x7f {
-		return ""
+		return "", false, false
+	}
+
+	key, end := c.key(req)
+	if key == "" {
+		return "", false, false
+	}
+
+	shard := &c.shards[c.shardIndex(key)]
+	shard.RLock()
+	entry, ok := shard.entries[key]
+	shard.RUnlock()
+	if !ok {
+		return "", false, false
+	}
+	if expired := time.Since(entry.deadline); expired >= c.grace {
+		return "", false, false
+	} else if expired >= 0 {
+		stale = true
+		refresh = entry.refreshing.CompareAndSwap(false, true)
+	}
+	if c.eviction == LRU {
+		entry.access.Store(time.Now().UnixNano())
+	}
+	// prepend correct ID, and echo the questions as asked
+	if end > 12 && end-2 <= len(entry.value) && equalFold(req[12:end], entry.value[10:end-2]) {
+		return req[:2] + entry.value[:10] + req[12:end] + entry.value[end-2:], stale, refresh
 	}
+	return req[:2] + entry.value, stale, refresh
+}
 
-	c.RLock()
-	defer c.RUnlock()
+func (c *cache) key(req string) (key string, end int) {
+	key, end = cacheKey(req)
+	if c.keyFunc != nil {
+		key = c.keyFunc(req)
+	}
+	return key, end
+}
 
-	if c.entries == nil {
-		return ""
+// cacheKey removes the message ID from req, and case folds question names,
+// so that names that differ only in case share cache entries.
+// It also returns the end offset of the questions, or -1.
+func cacheKey(req string) (key string, end int) {
+	req, end = mapNames(req, toLower)
+	return req[2:], end
+}
+
+// mapNames returns msg with f applied to the label bytes of question names,
+// and the end offset of the questions, or -1.
+func mapNames(msg string, f func(byte) byte) (res string, end int) {
+	var buf []byte
+	i := 12 // skip header
+	for n := getUint16(msg[4:]); n > 0; n-- {
+		for i < len(msg) && msg[i] != 0 && msg[i] < 0x40 {
+			j := i + 1 + int(msg[i])
+			for i++; i < j && i < len(msg); i++ {
+				if c := f(msg[i]); c != msg[i] {
+					if buf == nil {
+						buf = []byte(msg)
+					}
+					buf[i] = c
+				}
+			}
+		}
+		switch {
+		case i >= len(msg):
+			i = -1
+		case msg[i] == 0: // end of name
+			i += 1 + 4
+		case msg[i] >= 0xc0: // compressed name
+			i += 2 + 4
+		default: // reserved
+			i = -1
+		}
+		if i < 0 || i > len(msg) {
+			end = -1
+			break
+		}
+		end = i
 	}
 
-	// remove message ID
-	entry, ok := c.entries[req[2:]]
-	if ok && time.Until(entry.deadline) > 0 {
-		// prepend correct ID
-		return req[:2] + entry.value
+	if buf != nil {
+		return string(buf), end
+	}
+	return msg, end
+}
+
+func (c *cache) hit(req string, res string, stale bool) {
+	if c.onHit == nil {
+		return
+	}
+
+	var p dnsmessage.Parser
+	if _, err := p.Start([]byte(req)); err != nil {
+		return
+	}
+	q, err := p.Question()
+	if err != nil {
+		return
+	}
+
+	switch {
+	case res == "":
+		c.onHit(q.Name.String(), CacheMiss)
+	case negative(res) && stale:
+		c.onHit(q.Name.String(), CacheStaleNegativeHit)
+	case negative(res):
+		c.onHit(q.Name.String(), CacheNegativeHit)
+	case stale:
+		c.onHit(q.Name.String(), CacheStaleHit)
+	default:
+		c.onHit(q.Name.String(), CacheHit)
 	}
-	return ""
 }
 
 func invalid(req string, res string) bool {
@@ -184,15 +776,66 @@ func invalid(req string, res string) bool {
 	if res[3]&0xf != 0 && res[3]&0xf != 3 { // no error, or name error
 		return true
 	}
+	if getUint16(req[4:]) != 1 { // single question
+		return true
+	}
+	if !sameQuestions(req, res) { // same questions
+		return true
+	}
 	return false
 }
 
+func sameQuestions(req string, res string) bool {
+	qdcount := getUint16(req[4:])
+	if qdcount != getUint16(res[4:]) {
+		return false
+	}
+
+	i := 12 // skip header
+	for n := 0; n < qdcount; n++ {
+		name := getNameLen(req[i:])
+		if name < 0 || i+name+4 > len(req) || i+name+4 > len(res) {
+			return false
+		}
+		// names are case-insensitive, type and class must match
+		if !equalFold(req[i:i+name], res[i:i+name]) || req[i+name:i+name+4] != res[i+name:i+name+4] {
+			return false
+		}
+		i += name + 4
+	}
+	return true
+}
+
+func equalFold(a, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if toLower(a[i]) != toLower(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func toLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		c += 'a' - 'A'
+	}
+	return c
+}
+
 func nameError(res string) bool {
 	return res[3]&0xf == 3
 }
 
+func negative(res string) bool {
+	return nameError(res) || getUint16(res[6:]) == 0
+}
+
 func getTTL(msg string) time.Duration {
 	ttl := math.MaxInt32
+	neg := negative(msg)
 
 	qdcount := getUint16(msg[4:])
 	ancount := getUint16(msg[6:])
@@ -227,6 +870,12 @@ func getTTL(msg string) time.Duration {
 		if rtyp != 41 && rttl < ttl {
 			ttl = rttl
 		}
+		// negative responses are bounded by the SOA MINIMUM (RFC 2308)
+		if neg && rtyp == 6 && i >= ancount && i < ancount+nscount && rlen >= 4 {
+			if min := getUint32(msg[name+10+rlen-4:]); min < ttl {
+				ttl = min
+			}
+		}
 		msg = msg[name+10+rlen:]
 	}
 
@@ -238,21 +887,27 @@ func getNameLen(msg string) int {
 	for i < len(msg) {
 		if msg[i] == 0 {
 			// end of name
-			i += 1
-			break
+			return i + 1
 		}
 		if msg[i] >= 0xc0 {
 			// compressed name
-			i += 2
-			break
+			if i+2 > len(msg) {
+				return -1
+			}
+			return i + 2
 		}
 		if msg[i] >= 0x40 {
 			// reserved
 			return -1
 		}
 		i += int(msg[i] + 1)
+		if i >= 255 {
+			// name too long
+			return -1
+		}
 	}
-	return i
+	// truncated name
+	return -1
 }
 
 func getUint16(s string) int {
@@ -263,53 +918,89 @@ func getUint32(s string) int {
 	return int(s[3]) | int(s[2])<<8 | int(s[1])<<16 | int(s[0])<<24
 }
 
-func cachingRoundTrip(cache *cache, network, address string) roundTripper {
-	return func(ctx context.Context, req string) (res string, err error) {
-		// check cache
-		if res := cache.get(req); res != "" {
-			return res, nil
-		}
+// cacheRefreshTimeout bounds background refreshes of stale answers.
+const cacheRefreshTimeout = 5 * time.Second
+
+func cachingRoundTrip(cache *cache, dial DialFunc, network, address string, bypass bool, life context.Context) roundTripper {
+	if cache.tcp && network == "udp" {
+		network = "tcp"
+	}
 
-		// dial connection
-		var conn net.Conn
-		if cache.dial != nil {
-			conn, err = cache.dial(ctx, network, address)
-		} else {
-			var d net.Dialer
-			conn, err = d.DialContext(ctx, network, address)
+	query := func(ctx context.Context, req string) (string, error) {
+		// limit concurrent queries
+		if cache.sem != nil {
+			select {
+			case cache.sem <- struct{}{}:
+				defer func() { <-cache.sem }()
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
 		}
+
+		// exchange messages
+		res, err := exchange(ctx, dial, network, address, req)
 		if err != nil {
 			return "", err
 		}
 
-		ctx, cancel := context.WithCancel(ctx)
-		go func() {
-			<-ctx.Done()
-			conn.Close()
-		}()
-		defer cancel()
+		// cache response
+		if !cache.original {
+			res = cache.rewrite(req, res)
+		}
+		cache.put(req, res)
+		return res, nil
+	}
 
-		if t, ok := ctx.Deadline(); ok {
-			err = conn.SetDeadline(t)
-			if err != nil {
-				return "", err
-			}
+	refresh := func(req string) {
+		// refreshes stop when the resolver is closed
+		if life.Err() != nil {
+			return
 		}
+		ctx, cancel := context.WithTimeout(life, cacheRefreshTimeout)
+		defer cancel()
+		query(ctx, req)
+	}
 
-		// send request
-		err = writeMessage(conn, req)
-		if err != nil {
-			return "", err
+	return func(ctx context.Context, req string) (res string, err error) {
+		// rewrite query
+		if cache.ednsBufSize != 0 {
+			req = setEDNSBufSize(req, cache.ednsBufSize)
+		}
+		if cache.cd {
+			req = setCheckingDisabled(req)
 		}
 
-		// read response
-		res, err = readMessage(conn)
-		if err != nil {
-			return "", err
+		// check cache
+		if !bypass {
+			if res, stale, renew := cache.get(req); res != "" {
+				cache.hit(req, res, stale)
+				if renew {
+					go refresh(req)
+				}
+				if cache.original {
+					res = cache.rewrite(req, res)
+				}
+				return res, nil
+			}
+		}
+		cache.hit(req, "", false)
+		res, err = query(ctx, req)
+		if err == nil && cache.original {
+			res = cache.rewrite(req, res)
 		}
+		return res, err
+	}
+}
 
-		// cache response
-		cache.put(req, res)
-		return res, nil
+// rewrite returns res rewritten by the OnResponse function,
+// or res unchanged, if the rewritten response is invalid.
+func (c *cache) rewrite(req, res string) string {
+	if c.onResponse == nil {
+		return res
+	}
+	out := string(c.onResponse([]byte(req), []byte(res)))
+	if !validResponse(req, out) {
+		return res
 	}
+	return out
 }
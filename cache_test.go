@@ -3,10 +3,16 @@ package dns_test
 import (
 	"context"
 	"fmt"
+	"math"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"golang.org/x/net/dns/dnsmessage"
+
 	"github.com/ncruces/go-dns"
 )
 
@@ -68,3 +74,1147 @@ func TestNegativeCache(t *testing.T) {
 		t.Errorf("first %v, second %v", first, second)
 	}
 }
+
+func TestNegativeCache_noData(t *testing.T) {
+	zone := newTestZone()
+	zone.addHost("example.com.", "192.0.2.1")
+	var queries atomic.Int32
+	dial := pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+		queries.Add(1)
+		return zone.handler(req)
+	})
+	r := dns.NewCachingResolver(&net.Resolver{PreferGo: true, Dial: dial}, dns.NegativeCache(false))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name   string
+		typ    dnsmessage.Type
+		cached bool
+	}{
+		{"example.com.", dnsmessage.TypeA, true},           // positive
+		{"example.com.", dnsmessage.TypeAAAA, false},       // NODATA
+		{"nxdomain.example.com.", dnsmessage.TypeA, false}, // NXDOMAIN
+	}
+	for _, tt := range tests {
+		query := newQuery(t, 1, tt.name, tt.typ)
+		queries.Store(0)
+		for i := 0; i < 2; i++ {
+			if _, err := dns.Exchange(ctx, r, query); err != nil {
+				t.Fatalf("Exchange(%s %v) error = %v", tt.name, tt.typ, err)
+			}
+		}
+		want := int32(2)
+		if tt.cached {
+			want = 1
+		}
+		if got := queries.Load(); got != want {
+			t.Errorf("%s %v: got %d queries, wanted %d", tt.name, tt.typ, got, want)
+		}
+	}
+}
+
+func TestPositiveCache(t *testing.T) {
+	zone := newTestZone()
+	zone.addHost("example.com.", "192.0.2.1")
+	var queries atomic.Int32
+	dial := pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+		queries.Add(1)
+		return zone.handler(req)
+	})
+	r := dns.NewCachingResolver(&net.Resolver{PreferGo: true, Dial: dial}, dns.PositiveCache(false))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name   string
+		typ    dnsmessage.Type
+		cached bool
+	}{
+		{"example.com.", dnsmessage.TypeA, false},         // positive
+		{"example.com.", dnsmessage.TypeAAAA, true},       // NODATA
+		{"nxdomain.example.com.", dnsmessage.TypeA, true}, // NXDOMAIN
+	}
+	for _, tt := range tests {
+		query := newQuery(t, 1, tt.name, tt.typ)
+		queries.Store(0)
+		for i := 0; i < 2; i++ {
+			if _, err := dns.Exchange(ctx, r, query); err != nil {
+				t.Fatalf("Exchange(%s %v) error = %v", tt.name, tt.typ, err)
+			}
+		}
+		want := int32(2)
+		if tt.cached {
+			want = 1
+		}
+		if got := queries.Load(); got != want {
+			t.Errorf("%s %v: got %d queries, wanted %d", tt.name, tt.typ, got, want)
+		}
+	}
+}
+
+func TestWithNoCache(t *testing.T) {
+	var queries atomic.Int32
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			queries.Add(1)
+			return answer(req, 60, "192.0.2.1")
+		}),
+	})
+
+	lookup := func(ctx context.Context) {
+		ips, err := r.LookupIP(ctx, "ip4", "example.com.")
+		if err != nil {
+			t.Fatalf("LookupIP('example.com.') error = %v", err)
+		}
+		if len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+			t.Errorf("LookupIP('example.com.') = %v", ips)
+		}
+	}
+
+	lookup(context.TODO())
+	lookup(context.TODO())
+	if n := queries.Load(); n != 1 {
+		t.Errorf("got %d queries, wanted 1", n)
+	}
+
+	lookup(dns.WithNoCache(context.TODO()))
+	if n := queries.Load(); n != 2 {
+		t.Errorf("got %d queries, wanted 2", n)
+	}
+
+	lookup(context.TODO())
+	if n := queries.Load(); n != 2 {
+		t.Errorf("got %d queries, wanted 2", n)
+	}
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	var queries atomic.Int32
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			queries.Add(1)
+			return answer(req, 60, "192.0.2.1")
+		}),
+	}, dns.MaxCacheEntries(8), dns.EvictionPolicy(dns.LRU))
+
+	lookup := func(i int) {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		if _, err := r.LookupIP(context.TODO(), "ip4", name); err != nil {
+			t.Fatalf("LookupIP(%q) error = %v", name, err)
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		lookup(i)
+	}
+	lookup(0) // cached, most recently used
+	lookup(8) // evicts the least recently used
+	if n := queries.Load(); n != 9 {
+		t.Errorf("got %d queries, wanted 9", n)
+	}
+
+	lookup(0)
+	if n := queries.Load(); n != 9 {
+		t.Errorf("got %d queries, wanted 9", n)
+	}
+	lookup(1)
+	if n := queries.Load(); n != 10 {
+		t.Errorf("got %d queries, wanted 10", n)
+	}
+}
+
+func TestEvictionPolicy_replace(t *testing.T) {
+	for _, policy := range []dns.Eviction{dns.RandomSample, dns.LRU} {
+		var cache dns.Cache
+		r := dns.NewCachingResolver(&net.Resolver{
+			PreferGo: true,
+			Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+				return answer(req, 60, "192.0.2.1")
+			}),
+		}, dns.MaxCacheEntries(2), dns.EvictionPolicy(policy), dns.CacheHandle(&cache))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		for _, name := range []string{"a.example.com.", "b.example.com."} {
+			if _, err := dns.Exchange(ctx, r, newQuery(t, 1, name, dnsmessage.TypeA)); err != nil {
+				t.Fatalf("Exchange(%q) error = %v", name, err)
+			}
+		}
+
+		// replacing an entry of a full cache doesn't evict another,
+		// like the least recently used one
+		query := newQuery(t, 1, "a.example.com.", dnsmessage.TypeA)
+		if _, err := dns.Exchange(ctx, r, query); err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+		if _, err := dns.Exchange(dns.WithNoCache(ctx), r, query); err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+		if entries := cache.Entries(); len(entries) != 2 {
+			t.Errorf("policy %v: Entries() = %v", policy, entries)
+		}
+	}
+}
+
+func TestOnCacheHit(t *testing.T) {
+	var got []string
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			if req.Questions[0].Name.String() == "nxdomain.example.com." {
+				return answer(req, 60)
+			}
+			return answer(req, 60, "192.0.2.1")
+		}),
+	}, dns.OnCacheHit(func(question string, status dns.CacheStatus) {
+		got = append(got, fmt.Sprint(question, " ", status))
+	}))
+
+	for i := 0; i < 2; i++ {
+		r.LookupIP(context.TODO(), "ip4", "example.com.")
+		r.LookupIP(context.TODO(), "ip4", "nxdomain.example.com.")
+	}
+
+	want := []string{
+		fmt.Sprint("example.com. ", dns.CacheMiss),
+		fmt.Sprint("nxdomain.example.com. ", dns.CacheMiss),
+		fmt.Sprint("example.com. ", dns.CacheHit),
+		fmt.Sprint("nxdomain.example.com. ", dns.CacheNegativeHit),
+	}
+	if !check(got, want) {
+		t.Errorf("OnCacheHit got %v, wanted %v", got, want)
+	}
+}
+
+func TestOnCacheHit_stale(t *testing.T) {
+	var got []string
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			if req.Questions[0].Name.String() == "nxdomain.example.com." {
+				return answer(req, 60)
+			}
+			return answer(req, 60, "192.0.2.1")
+		}),
+	},
+		dns.MaxCacheTTL(time.Millisecond),
+		dns.CacheGrace(time.Hour),
+		dns.OnCacheHit(func(question string, status dns.CacheStatus) {
+			got = append(got, fmt.Sprint(question, " ", status))
+		}))
+
+	r.LookupIP(context.TODO(), "ip4", "example.com.")
+	r.LookupIP(context.TODO(), "ip4", "nxdomain.example.com.")
+	time.Sleep(10 * time.Millisecond)
+	r.LookupIP(context.TODO(), "ip4", "example.com.")
+	r.LookupIP(context.TODO(), "ip4", "nxdomain.example.com.")
+
+	want := []string{
+		fmt.Sprint("example.com. ", dns.CacheMiss),
+		fmt.Sprint("nxdomain.example.com. ", dns.CacheMiss),
+		fmt.Sprint("example.com. ", dns.CacheStaleHit),
+		fmt.Sprint("nxdomain.example.com. ", dns.CacheStaleNegativeHit),
+	}
+	if !check(got, want) {
+		t.Errorf("OnCacheHit got %v, wanted %v", got, want)
+	}
+}
+
+func TestCacheRand(t *testing.T) {
+	tests := []struct {
+		name string
+		rand func() uint64
+		want int32
+	}{
+		{"NoJitter", func() uint64 { return 0 }, 1},
+		{"FullJitter", func() uint64 { return math.MaxUint64 }, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queries atomic.Int32
+			r := dns.NewCachingResolver(&net.Resolver{
+				PreferGo: true,
+				Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+					queries.Add(1)
+					return answer(req, 60, "192.0.2.1")
+				}),
+			}, dns.TTLJitter(1), dns.CacheRand(tt.rand))
+
+			for i := 0; i < 2; i++ {
+				if _, err := r.LookupIP(context.TODO(), "ip4", "example.com."); err != nil {
+					t.Fatalf("LookupIP('example.com.') error = %v", err)
+				}
+			}
+			if n := queries.Load(); n != tt.want {
+				t.Errorf("got %d queries, wanted %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		jitter float64
+		rand   func() uint64
+		want   time.Duration
+	}{
+		{"NoJitter", 0, func() uint64 { return math.MaxUint64 }, time.Hour},
+		{"HalfJitter", 0.5, func() uint64 { return 1 << 63 }, 45 * time.Minute},
+		{"FullJitter", 1, func() uint64 { return 1 << 62 }, 45 * time.Minute},
+		{"Invalid", 2, func() uint64 { return 1 << 63 }, time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cache dns.Cache
+			r := dns.NewCachingResolver(&net.Resolver{
+				PreferGo: true,
+				Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+					return answer(req, 3600, "192.0.2.1")
+				}),
+			}, dns.TTLJitter(tt.jitter), dns.CacheRand(tt.rand), dns.CacheHandle(&cache))
+
+			if _, err := r.LookupIP(context.TODO(), "ip4", "example.com."); err != nil {
+				t.Fatalf("LookupIP('example.com.') error = %v", err)
+			}
+			entries := cache.Entries()
+			if len(entries) != 1 {
+				t.Fatalf("Entries() = %v", entries)
+			}
+			if ttl := entries[0].RemainingTTL; ttl <= tt.want-time.Minute || ttl > tt.want {
+				t.Errorf("RemainingTTL = %v, wanted %v", ttl, tt.want)
+			}
+		})
+	}
+}
+
+func TestEDNSBufSize(t *testing.T) {
+	var size atomic.Int32
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			size.Store(-1)
+			for _, rr := range req.Additionals {
+				if rr.Header.Type == dnsmessage.TypeOPT {
+					size.Store(int32(rr.Header.Class))
+				}
+			}
+			return answer(req, 60, "192.0.2.1")
+		}),
+	}, dns.EDNSBufSize(4096))
+
+	// the standard library adds an OPT record
+	if _, err := r.LookupIP(context.TODO(), "ip4", "example.com."); err != nil {
+		t.Fatalf("LookupIP('example.com.') error = %v", err)
+	}
+	if n := size.Load(); n != 4096 {
+		t.Errorf("got EDNS buffer size %d, wanted 4096", n)
+	}
+
+	// this query has no OPT record
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.org.", dnsmessage.TypeA)
+	if _, err := dns.Exchange(ctx, r, query); err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+	if n := size.Load(); n != 4096 {
+		t.Errorf("got EDNS buffer size %d, wanted 4096", n)
+	}
+}
+
+func TestCacheTypes(t *testing.T) {
+	var queries atomic.Int32
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			queries.Add(1)
+			return answer(req, 60, "192.0.2.1", "2001:db8::1")
+		}),
+	}, dns.CacheTypes(dnsmessage.TypeA))
+
+	lookup := func(network string) {
+		if _, err := r.LookupIP(context.TODO(), network, "example.com."); err != nil {
+			t.Fatalf("LookupIP('example.com.') error = %v", err)
+		}
+	}
+
+	lookup("ip4")
+	lookup("ip4")
+	if n := queries.Load(); n != 1 {
+		t.Errorf("got %d queries, wanted 1", n)
+	}
+
+	lookup("ip6")
+	lookup("ip6")
+	if n := queries.Load(); n != 3 {
+		t.Errorf("got %d queries, wanted 3", n)
+	}
+}
+
+func TestCacheClasses(t *testing.T) {
+	var queries atomic.Int32
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			queries.Add(1)
+			q := req.Questions[0]
+			if q.Class != dnsmessage.ClassCHAOS {
+				return answer(req, 60, "192.0.2.1")
+			}
+			res := answer(req, 60)
+			res.RCode = dnsmessage.RCodeSuccess
+			res.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.TXTResource{TXT: []string{"test"}},
+			}}
+			return res
+		}),
+	}, dns.CacheClasses(dnsmessage.ClassINET))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	exchange := func(name string, typ dnsmessage.Type, class dnsmessage.Class) {
+		query := dnsmessage.Message{
+			Header: dnsmessage.Header{ID: 1},
+			Questions: []dnsmessage.Question{{
+				Name:  dnsmessage.MustNewName(name),
+				Type:  typ,
+				Class: class,
+			}},
+		}
+		buf, err := query.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dns.Exchange(ctx, r, buf); err != nil {
+			t.Fatalf("Exchange(%q) error = %v", name, err)
+		}
+	}
+
+	exchange("version.bind.", dnsmessage.TypeTXT, dnsmessage.ClassCHAOS)
+	exchange("version.bind.", dnsmessage.TypeTXT, dnsmessage.ClassCHAOS)
+	if n := queries.Load(); n != 2 {
+		t.Errorf("got %d queries, wanted 2", n)
+	}
+
+	exchange("example.com.", dnsmessage.TypeA, dnsmessage.ClassINET)
+	exchange("example.com.", dnsmessage.TypeA, dnsmessage.ClassINET)
+	if n := queries.Load(); n != 3 {
+		t.Errorf("got %d queries, wanted 3", n)
+	}
+}
+
+func TestOnResponse(t *testing.T) {
+	rewrite := func(query, response []byte) []byte {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(response); err != nil || len(msg.Questions) == 0 {
+			return response
+		}
+		q := msg.Questions[0]
+		switch q.Name.String() {
+		case "blocked.example.":
+			res, _ := dns.BuildResponse(query, dnsmessage.RCodeSuccess, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{0, 0, 0, 0}},
+			})
+			return res
+		case "garbage.example.":
+			return []byte("garbage")
+		}
+		return response
+	}
+
+	tests := []struct {
+		name    string
+		options []dns.CacheOption
+		calls   int32
+	}{
+		{"Default", nil, 2},
+		{"Original", []dns.CacheOption{dns.CacheOriginalResponses()}, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			options := append(tt.options, dns.OnResponse(func(query, response []byte) []byte {
+				calls.Add(1)
+				return rewrite(query, response)
+			}))
+			r := dns.NewCachingResolver(&net.Resolver{
+				PreferGo: true,
+				Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+					return answer(req, 60, "192.0.2.1")
+				}),
+			}, options...)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			for i := 0; i < 2; i++ {
+				for _, tc := range []struct{ name, want string }{
+					{"blocked.example.", "0.0.0.0"},
+					{"garbage.example.", "192.0.2.1"},
+				} {
+					res, err := dns.Exchange(ctx, r, newQuery(t, uint16(i+1), tc.name, dnsmessage.TypeA))
+					if err != nil {
+						t.Fatalf("Exchange(%q) error = %v", tc.name, err)
+					}
+					var msg dnsmessage.Message
+					if err := msg.Unpack(res); err != nil {
+						t.Fatalf("Unpack(...) error = %v", err)
+					}
+					if msg.ID != uint16(i+1) || len(msg.Answers) != 1 {
+						t.Fatalf("Exchange(%q) = %v", tc.name, msg)
+					}
+					a := msg.Answers[0].Body.(*dnsmessage.AResource)
+					if ip := net.IP(a.A[:]).String(); ip != tc.want {
+						t.Errorf("Exchange(%q) = %v, wanted %v", tc.name, ip, tc.want)
+					}
+				}
+			}
+			if n := calls.Load(); n != tt.calls {
+				t.Errorf("got %d calls, wanted %d", n, tt.calls)
+			}
+		})
+	}
+}
+
+func TestMessageTTL(t *testing.T) {
+	name := dnsmessage.MustNewName("example.com.")
+	soa := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.SOAResource{NS: name, MBox: name, MinTTL: 30},
+	}
+	a := func(ttl uint32) dnsmessage.Resource {
+		return dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		header    dnsmessage.Header
+		answers   []dnsmessage.Resource
+		authority []dnsmessage.Resource
+		want      time.Duration
+		wantErr   bool
+	}{
+		{"Answers", dnsmessage.Header{Response: true}, []dnsmessage.Resource{a(60), a(40)}, nil, 40 * time.Second, false},
+		{"NXDOMAIN", dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError}, nil, []dnsmessage.Resource{soa}, 30 * time.Second, false},
+		{"NODATA", dnsmessage.Header{Response: true}, nil, []dnsmessage.Resource{soa}, 30 * time.Second, false},
+		{"Empty", dnsmessage.Header{Response: true}, nil, nil, 0, true},
+		{"Query", dnsmessage.Header{}, []dnsmessage.Resource{a(60)}, nil, 0, true},
+		{"Truncated", dnsmessage.Header{Response: true, Truncated: true}, []dnsmessage.Resource{a(60)}, nil, 0, true},
+		{"SERVFAIL", dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeServerFailure}, nil, []dnsmessage.Resource{soa}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := dnsmessage.Message{
+				Header:      tt.header,
+				Questions:   []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+				Answers:     tt.answers,
+				Authorities: tt.authority,
+			}
+			buf, err := msg.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := dns.MessageTTL(buf)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("MessageTTL(...) error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("MessageTTL(...) = %v, wanted %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := dns.MessageTTL([]byte("\x00\x00\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00\xc0")); err == nil {
+		t.Error("MessageTTL(...) of a malformed message succeeded")
+	}
+}
+
+func TestForceTCP(t *testing.T) {
+	var networks []string
+	var mtx sync.Mutex
+	dial := pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	parent := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			mtx.Lock()
+			networks = append(networks, network)
+			mtx.Unlock()
+			return dial(ctx, network, address)
+		},
+	}
+	r := dns.NewCachingResolver(parent, dns.ForceTCP())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := r.LookupIPAddr(ctx, "example.com."); err != nil {
+		t.Fatalf("LookupIPAddr('example.com.') error = %v", err)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(networks) == 0 {
+		t.Fatal("parent wasn't dialed")
+	}
+	for _, n := range networks {
+		if n != "tcp" {
+			t.Errorf("got network %q, wanted tcp", n)
+		}
+	}
+}
+
+func TestCache_noSOA(t *testing.T) {
+	var queries atomic.Int32
+	dial := pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+		queries.Add(1)
+		// NODATA, without an SOA record to bound its TTL
+		res := answer(req, 60)
+		res.RCode = dnsmessage.RCodeSuccess
+		res.Authorities = nil
+		return res
+	})
+	r := dns.NewCachingResolver(&net.Resolver{PreferGo: true, Dial: dial})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	for i := 0; i < 2; i++ {
+		res, err := dns.Exchange(ctx, r, query)
+		if err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+		if _, err := dns.MessageTTL(res); err == nil {
+			t.Error("MessageTTL(...) succeeded")
+		}
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("got %d queries, wanted 2", n)
+	}
+}
+
+func TestNegativeCacheTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		rcode  dnsmessage.RCode
+		minTTL uint32
+		want   int32
+	}{
+		{"NXDOMAIN", dnsmessage.RCodeNameError, 3600, 1},
+		{"NXDOMAIN/NoMinimum", dnsmessage.RCodeNameError, 0, 2},
+		{"NODATA", dnsmessage.RCodeSuccess, 3600, 1},
+		{"NODATA/NoMinimum", dnsmessage.RCodeSuccess, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queries atomic.Int32
+			r := dns.NewCachingResolver(&net.Resolver{
+				PreferGo: true,
+				Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+					if req.Questions[0].Type == dnsmessage.TypeA {
+						return answer(req, 60, "192.0.2.1")
+					}
+					queries.Add(1)
+					res := answer(req, 60)
+					res.RCode = tt.rcode
+					res.Authorities = []dnsmessage.Resource{{
+						Header: dnsmessage.ResourceHeader{
+							Name:  dnsmessage.MustNewName("example.com."),
+							Type:  dnsmessage.TypeSOA,
+							Class: dnsmessage.ClassINET,
+							TTL:   3600,
+						},
+						Body: &dnsmessage.SOAResource{
+							NS:     dnsmessage.MustNewName("ns.example.com."),
+							MBox:   dnsmessage.MustNewName("hostmaster.example.com."),
+							MinTTL: tt.minTTL,
+						},
+					}}
+					return res
+				}),
+			})
+
+			for i := 0; i < 2; i++ {
+				r.LookupIP(context.TODO(), "ip6", "example.com.")
+			}
+			if n := queries.Load(); n != tt.want {
+				t.Errorf("got %d queries, wanted %d", n, tt.want)
+			}
+
+			// a negative AAAA answer doesn't affect A lookups
+			if tt.rcode == dnsmessage.RCodeSuccess {
+				ips, err := r.LookupIP(context.TODO(), "ip4", "example.com.")
+				if err != nil {
+					t.Fatalf("LookupIP('example.com.') error = %v", err)
+				}
+				if len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+					t.Errorf("LookupIP('example.com.') = %v", ips)
+				}
+			}
+		})
+	}
+}
+
+func TestMinNegativeCacheTTL(t *testing.T) {
+	var queries atomic.Int32
+	var cache dns.Cache
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			queries.Add(1)
+			// NXDOMAIN, with an SOA MINIMUM below the minimum
+			res := answer(req, 3600)
+			res.Authorities[0].Body.(*dnsmessage.SOAResource).MinTTL = 1
+			return res
+		}),
+	}, dns.MinNegativeCacheTTL(time.Hour), dns.CacheHandle(&cache))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "nxdomain.example.com.", dnsmessage.TypeA)
+	for i := 0; i < 2; i++ {
+		if _, err := dns.Exchange(ctx, r, query); err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("got %d queries, wanted 1", n)
+	}
+
+	entries := cache.Entries()
+	if len(entries) != 1 {
+		t.Fatalf("Entries() = %v", entries)
+	}
+	if ttl := entries[0].RemainingTTL; ttl <= time.Hour-time.Minute || ttl > time.Hour {
+		t.Errorf("RemainingTTL = %v, wanted %v", ttl, time.Hour)
+	}
+}
+func TestMaxConcurrentQueries(t *testing.T) {
+	var active, peak atomic.Int32
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			n := active.Add(1)
+			defer active.Add(-1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			return answer(req, 60, "192.0.2.1")
+		}),
+	}, dns.MaxConcurrentQueries(2))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("host%d.example.com.", i)
+			if _, err := r.LookupIP(context.TODO(), "ip4", name); err != nil {
+				t.Errorf("LookupIP(%q) error = %v", name, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := peak.Load(); n > 2 {
+		t.Errorf("got %d concurrent queries, wanted at most 2", n)
+	}
+}
+
+func TestCacheKey_case(t *testing.T) {
+	var queries atomic.Int32
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			queries.Add(1)
+			return answer(req, 60, "192.0.2.1")
+		}),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, name := range []string{"example.com.", "Example.COM.", "EXAMPLE.com."} {
+		query := newQuery(t, 1, name, dnsmessage.TypeA)
+		res, err := dns.Exchange(ctx, r, query)
+		if err != nil {
+			t.Fatalf("Exchange(%q) error = %v", name, err)
+		}
+
+		// the question is echoed as asked
+		var msg dnsmessage.Message
+		if err := msg.Unpack(res); err != nil {
+			t.Fatalf("Unpack(...) error = %v", err)
+		}
+		if got := msg.Questions[0].Name.String(); got != name {
+			t.Errorf("Exchange(%q) question = %q", name, got)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("got %d queries, wanted 1", n)
+	}
+}
+
+func TestCacheKeyFunc(t *testing.T) {
+	var queries atomic.Int32
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			queries.Add(1)
+			return answer(req, 60, "192.0.2.1")
+		}),
+	}, dns.CacheKeyFunc(func(query string) string {
+		if strings.Contains(query, "\x07nocache") {
+			return ""
+		}
+		return query[2:]
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		for _, name := range []string{"example.com.", "nocache.example.com."} {
+			if _, err := dns.Exchange(ctx, r, newQuery(t, uint16(i), name, dnsmessage.TypeA)); err != nil {
+				t.Fatalf("Exchange(%q) error = %v", name, err)
+			}
+		}
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("got %d queries, wanted 3", n)
+	}
+}
+
+func TestCacheTTLByType(t *testing.T) {
+	var queries [2]atomic.Int32
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			if req.Questions[0].Type == dnsmessage.TypeA {
+				queries[0].Add(1)
+			} else {
+				queries[1].Add(1)
+			}
+			return answer(req, 60, "192.0.2.1", "2001:db8::1")
+		}),
+	},
+		dns.MaxCacheTTL(time.Nanosecond),
+		dns.CacheTTLByType(map[dnsmessage.Type]dns.TTLBounds{
+			dnsmessage.TypeAAAA: {Max: time.Hour},
+		}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			if _, err := dns.Exchange(ctx, r, newQuery(t, uint16(i), "example.com.", typ)); err != nil {
+				t.Fatalf("Exchange(...) error = %v", err)
+			}
+		}
+	}
+	// A answers expire immediately, AAAA answers are cached
+	if a, aaaa := queries[0].Load(), queries[1].Load(); a != 2 || aaaa != 1 {
+		t.Errorf("got %d A and %d AAAA queries, wanted 2 and 1", a, aaaa)
+	}
+}
+
+func TestCache_Entries(t *testing.T) {
+	var cache dns.Cache
+	if entries := cache.Entries(); entries != nil {
+		t.Errorf("Entries() on unbound cache = %v", entries)
+	}
+
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			return answer(req, 60, "192.0.2.1", "2001:db8::1")
+		}),
+	}, dns.CacheHandle(&cache))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA} {
+		if _, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", typ)); err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+	}
+
+	entries := cache.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("Entries() = %v", entries)
+	}
+	for i, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		e := entries[i]
+		if e.Question != "example.com." || e.Type != typ || e.RemainingTTL <= 0 || e.RemainingTTL > time.Minute {
+			t.Errorf("Entries()[%d] = %+v", i, e)
+		}
+	}
+}
+
+func TestCacheGrace(t *testing.T) {
+	var queries atomic.Int32
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			n := queries.Add(1)
+			return answer(req, 60, fmt.Sprintf("192.0.2.%d", n))
+		}),
+	},
+		dns.MaxCacheTTL(time.Millisecond),
+		dns.CacheGrace(time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lookup := func() string {
+		res, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA))
+		if err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(res); err != nil || len(msg.Answers) != 1 {
+			t.Fatalf("Unpack(...) = %v, %v", msg, err)
+		}
+		return msg.Answers[0].Body.GoString()
+	}
+
+	first := lookup()
+	time.Sleep(10 * time.Millisecond)
+
+	// the expired answer is served, and refreshed in the background
+	if got := lookup(); got != first {
+		t.Errorf("got %s, wanted %s", got, first)
+	}
+	for i := 0; queries.Load() < 2 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Fatalf("got %d queries, wanted 2", n)
+	}
+
+	// the refreshed answer is served
+	if got := lookup(); got == first {
+		t.Errorf("got %s, wanted a refreshed answer", got)
+	}
+}
+
+func TestCacheGrace_refreshOnce(t *testing.T) {
+	var queries atomic.Int32
+	var stale atomic.Int32
+	release := make(chan struct{})
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			if queries.Add(1) > 1 {
+				<-release // hold the refresh
+			}
+			return answer(req, 60, "192.0.2.1")
+		}),
+	},
+		dns.MaxCacheTTL(time.Millisecond),
+		dns.CacheGrace(time.Hour),
+		dns.OnCacheHit(func(question string, status dns.CacheStatus) {
+			if status == dns.CacheStaleHit {
+				stale.Add(1)
+			}
+		}))
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	if _, err := dns.Exchange(ctx, r, query); err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// grace hits while the refresh is pending don't refresh again
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := dns.Exchange(ctx, r, query); err != nil {
+				t.Errorf("Exchange(...) error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := 0; queries.Load() < 2 && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if n := queries.Load(); n != 2 {
+		t.Errorf("got %d queries, wanted 2", n)
+	}
+	if n := stale.Load(); n != 10 {
+		t.Errorf("got %d stale hits, wanted 10", n)
+	}
+}
+
+func TestCheckingDisabled(t *testing.T) {
+	var cd atomic.Bool
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			cd.Store(req.CheckingDisabled)
+			return answer(req, 60, "192.0.2.1")
+		}),
+	}, dns.CheckingDisabled())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	res, err := dns.Exchange(ctx, r, query)
+	if err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+	if !cd.Load() {
+		t.Error("query sent without the CD bit")
+	}
+
+	// other flags are preserved
+	var msg dnsmessage.Message
+	if err := msg.Unpack(res); err != nil {
+		t.Fatalf("Unpack(...) error = %v", err)
+	}
+	if !msg.RecursionDesired {
+		t.Error("query sent without the RD bit")
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	var queries [2]atomic.Int32
+	upstream := func(i int) *net.Resolver {
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+				queries[i].Add(1)
+				return answer(req, 60, "192.0.2.1")
+			}),
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, shared := range []*dns.Cache{dns.NewCache(), {}} {
+		queries[0].Store(0)
+		queries[1].Store(0)
+		r0 := dns.NewCachingResolver(upstream(0), dns.SharedCache(shared))
+		r1 := dns.NewCachingResolver(upstream(1), dns.SharedCache(shared))
+
+		// the first answer is shared by concurrent lookups
+		lookup := func(r *net.Resolver) {
+			if _, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA)); err != nil {
+				t.Errorf("Exchange(...) error = %v", err)
+			}
+		}
+		lookup(r0)
+		var wg sync.WaitGroup
+		for _, r := range []*net.Resolver{r1, r0, r1} {
+			wg.Add(1)
+			go func(r *net.Resolver) {
+				defer wg.Done()
+				lookup(r)
+			}(r)
+		}
+		wg.Wait()
+
+		if q0, q1 := queries[0].Load(), queries[1].Load(); q0 != 1 || q1 != 0 {
+			t.Errorf("got %d and %d queries, wanted 1 and 0", q0, q1)
+		}
+		if entries := shared.Entries(); len(entries) != 1 {
+			t.Errorf("Entries() = %v", entries)
+		}
+	}
+}
+
+func TestStrictErrors(t *testing.T) {
+	parent := &net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			res := answer(req, 60, "192.0.2.1")
+			if req.Questions[0].Type == dnsmessage.TypeAAAA {
+				res.RCode = dnsmessage.RCodeServerFailure
+			}
+			return res
+		}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r := dns.NewCachingResolver(parent)
+	if ips, err := r.LookupIPAddr(ctx, "example.com"); err != nil || !checkIPAddrs(ips, "192.0.2.1") {
+		t.Errorf("LookupIPAddr(...) = %v, %v", ips, err)
+	}
+
+	r = dns.NewCachingResolver(parent, dns.StrictErrors(true))
+	if !r.StrictErrors {
+		t.Error("StrictErrors not set")
+	}
+	if ips, err := r.LookupIPAddr(ctx, "example.com"); err == nil {
+		t.Errorf("LookupIPAddr(...) = %v, wanted error", ips)
+	}
+}
+
+func BenchmarkCache_parallel(b *testing.B) {
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			return answer(req, 3600, "192.0.2.1")
+		}),
+	}, dns.MaxCacheEntries(1000))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	queries := make([][]byte, 1000)
+	for i := range queries {
+		queries[i] = newQuery(b, 1, fmt.Sprintf("host%d.example.com.", i), dnsmessage.TypeA)
+		if _, err := dns.Exchange(ctx, r, queries[i]); err != nil {
+			b.Fatalf("Exchange(...) error = %v", err)
+		}
+	}
+
+	var next atomic.Int32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(next.Add(1))
+		for pb.Next() {
+			if _, err := dns.Exchange(ctx, r, queries[i%len(queries)]); err != nil {
+				b.Errorf("Exchange(...) error = %v", err)
+				return
+			}
+			i += 7
+		}
+	})
+}
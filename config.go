@@ -0,0 +1,259 @@
+package dns
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A ResolverConfig describes a DNS over TLS or DNS over HTTPS resolver.
+// Exactly one of DoT and DoH must be set.
+//
+// A ResolverConfig can be serialized as JSON, for instance to be loaded from a configuration file;
+// durations are serialized as strings, like "5m".
+type ResolverConfig struct {
+	DoT        string       // the server of a DNS over TLS resolver, see [NewDoTResolver]
+	DoH        string       // the URI of a DNS over HTTPS resolver, see [NewDoHResolver]
+	Addresses  []string     // see [DoTAddresses] and [DoHAddresses]
+	ServerName string       // DNS over TLS only, see [DoTServerName]
+	Cache      *CacheConfig // if not nil, adds caching to the resolver
+}
+
+// A CacheConfig describes the cache of a resolver.
+// Zero values leave the defaults unchanged.
+type CacheConfig struct {
+	MaxEntries     int           // see [MaxCacheEntries]
+	MaxTTL         time.Duration // see [MaxCacheTTL]
+	MinTTL         time.Duration // see [MinCacheTTL]
+	MinNegativeTTL time.Duration // see [MinNegativeCacheTTL]
+	NoNegative     bool          // disables negative caching, see [NegativeCache]
+	TTLJitter      float64       // see [TTLJitter]
+	EDNSBufSize    uint16        // see [EDNSBufSize]
+	Types          []dnsmessage.Type
+}
+
+// NewResolver creates a resolver from config.
+func NewResolver(config ResolverConfig) (*net.Resolver, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	if config.DoT != "" {
+		var opts []DoTOption
+		if config.Addresses != nil {
+			opts = append(opts, DoTAddresses(config.Addresses...))
+		}
+		if config.ServerName != "" {
+			opts = append(opts, DoTServerName(config.ServerName))
+		}
+		if config.Cache != nil {
+			opts = append(opts, DoTCache(config.Cache.options()...))
+		}
+		return NewDoTResolver(config.DoT, opts...)
+	}
+
+	var opts []DoHOption
+	if config.Addresses != nil {
+		opts = append(opts, DoHAddresses(config.Addresses...))
+	}
+	if config.Cache != nil {
+		opts = append(opts, DoHCache(config.Cache.options()...))
+	}
+	return NewDoHResolver(config.DoH, opts...)
+}
+
+// NewResolverFromURL creates a resolver from a URL, dispatching on its scheme:
+//   - "https://" creates a DNS over HTTPS resolver for the URI, see [NewDoHResolver];
+//   - "tls://host[:port]" or "dot://host[:port]" creates a DNS over TLS resolver, see [NewDoTResolver];
+//   - "dns://ip[:port]" or "udp://ip[:port]" creates a plain DNS resolver, see [NewPlainResolver];
+//   - "tcp://ip[:port]" creates a plain DNS resolver that only uses TCP.
+//
+// This makes resolvers configurable from a single string, like an environment variable or flag.
+func NewResolverFromURL(u string) (*net.Resolver, error) {
+	scheme, _, ok := strings.Cut(u, "://")
+	if !ok {
+		return nil, fmt.Errorf("dns: invalid URL %q", u)
+	}
+	scheme = strings.ToLower(scheme)
+	if scheme == "https" {
+		// may be an URI Template, so pass it through
+		return NewDoHResolver(u)
+	}
+
+	p, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("dns: invalid URL %q: %w", u, err)
+	}
+	if p.Host == "" {
+		return nil, fmt.Errorf("dns: invalid URL %q: missing host", u)
+	}
+
+	switch scheme {
+	case "tls", "dot":
+		return NewDoTResolver(p.Host)
+	case "dns", "udp":
+		return NewPlainResolver([]string{p.Host})
+	case "tcp":
+		return NewPlainResolver([]string{p.Host}, PlainForceTCP())
+	default:
+		return nil, fmt.Errorf("dns: unsupported URL scheme %q", scheme)
+	}
+}
+
+func (c ResolverConfig) validate() error {
+	switch {
+	case c.DoT == "" && c.DoH == "":
+		return errors.New("dns: config: one of DoT or DoH is required")
+	case c.DoT != "" && c.DoH != "":
+		return errors.New("dns: config: DoT and DoH are mutually exclusive")
+	case c.DoH != "" && c.ServerName != "":
+		return errors.New("dns: config: ServerName requires DoT")
+	}
+	return nil
+}
+
+func (c *CacheConfig) options() []CacheOption {
+	var opts []CacheOption
+	if c.MaxEntries != 0 {
+		opts = append(opts, MaxCacheEntries(c.MaxEntries))
+	}
+	if c.MaxTTL != 0 {
+		opts = append(opts, MaxCacheTTL(c.MaxTTL))
+	}
+	if c.MinTTL != 0 {
+		opts = append(opts, MinCacheTTL(c.MinTTL))
+	}
+	if c.MinNegativeTTL != 0 {
+		opts = append(opts, MinNegativeCacheTTL(c.MinNegativeTTL))
+	}
+	if c.NoNegative {
+		opts = append(opts, NegativeCache(false))
+	}
+	if c.TTLJitter != 0 {
+		opts = append(opts, TTLJitter(c.TTLJitter))
+	}
+	if c.EDNSBufSize != 0 {
+		opts = append(opts, EDNSBufSize(c.EDNSBufSize))
+	}
+	if c.Types != nil {
+		opts = append(opts, CacheTypes(c.Types...))
+	}
+	return opts
+}
+
+// cacheConfig returns the effective configuration of a cache created with options.
+func cacheConfig(options []CacheOption) *CacheConfig {
+	c := &cache{negative: true}
+	for _, o := range options {
+		o.apply(c)
+	}
+	if c.shared != nil {
+		if s := c.shared.cache.Load(); s != nil {
+			c = s
+		}
+	}
+	if c.maxEntries == 0 {
+		c.maxEntries = DefaultMaxCacheEntries
+	}
+	return &CacheConfig{
+		MaxEntries:     c.maxEntries,
+		MaxTTL:         c.maxTTL,
+		MinTTL:         c.minTTL,
+		MinNegativeTTL: c.minNegTTL,
+		NoNegative:     !c.negative,
+		TTLJitter:      c.jitter,
+		EDNSBufSize:    c.ednsBufSize,
+		Types:          c.types,
+	}
+}
+
+type resolverConfigJSON struct {
+	DoT        string           `json:"dot,omitempty"`
+	DoH        string           `json:"doh,omitempty"`
+	Addresses  []string         `json:"addresses,omitempty"`
+	ServerName string           `json:"server_name,omitempty"`
+	Cache      *cacheConfigJSON `json:"cache,omitempty"`
+}
+
+type cacheConfigJSON struct {
+	MaxEntries     int               `json:"max_entries,omitempty"`
+	MaxTTL         jsonDuration      `json:"max_ttl,omitempty"`
+	MinTTL         jsonDuration      `json:"min_ttl,omitempty"`
+	MinNegativeTTL jsonDuration      `json:"min_negative_ttl,omitempty"`
+	NoNegative     bool              `json:"no_negative,omitempty"`
+	TTLJitter      float64           `json:"ttl_jitter,omitempty"`
+	EDNSBufSize    uint16            `json:"edns_buf_size,omitempty"`
+	Types          []dnsmessage.Type `json:"types,omitempty"`
+}
+
+// MarshalJSON implements [json.Marshaler].
+func (c ResolverConfig) MarshalJSON() ([]byte, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	j := resolverConfigJSON{
+		DoT:        c.DoT,
+		DoH:        c.DoH,
+		Addresses:  c.Addresses,
+		ServerName: c.ServerName,
+	}
+	if c.Cache != nil {
+		j.Cache = &cacheConfigJSON{
+			MaxEntries:     c.Cache.MaxEntries,
+			MaxTTL:         jsonDuration(c.Cache.MaxTTL),
+			MinTTL:         jsonDuration(c.Cache.MinTTL),
+			MinNegativeTTL: jsonDuration(c.Cache.MinNegativeTTL),
+			NoNegative:     c.Cache.NoNegative,
+			TTLJitter:      c.Cache.TTLJitter,
+			EDNSBufSize:    c.Cache.EDNSBufSize,
+			Types:          c.Cache.Types,
+		}
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON implements [json.Unmarshaler].
+func (c *ResolverConfig) UnmarshalJSON(data []byte) error {
+	var j resolverConfigJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*c = ResolverConfig{
+		DoT:        j.DoT,
+		DoH:        j.DoH,
+		Addresses:  j.Addresses,
+		ServerName: j.ServerName,
+	}
+	if j.Cache != nil {
+		c.Cache = &CacheConfig{
+			MaxEntries:     j.Cache.MaxEntries,
+			MaxTTL:         time.Duration(j.Cache.MaxTTL),
+			MinTTL:         time.Duration(j.Cache.MinTTL),
+			MinNegativeTTL: time.Duration(j.Cache.MinNegativeTTL),
+			NoNegative:     j.Cache.NoNegative,
+			TTLJitter:      j.Cache.TTLJitter,
+			EDNSBufSize:    j.Cache.EDNSBufSize,
+			Types:          j.Cache.Types,
+		}
+	}
+	return c.validate()
+}
+
+// jsonDuration is a time.Duration serialized as a string.
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *jsonDuration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	*d = jsonDuration(v)
+	return err
+}
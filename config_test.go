@@ -0,0 +1,202 @@
+package dns_test
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/ncruces/go-dns"
+)
+
+func ExampleNewResolver() {
+	var config dns.ResolverConfig
+	err := json.Unmarshal([]byte(`{
+		"dot": "dns.google",
+		"addresses": ["8.8.8.8", "8.8.4.4"],
+		"cache": {"max_ttl": "5m"}
+	}`), &config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = dns.NewResolver(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func TestResolverConfig_JSON(t *testing.T) {
+	config := dns.ResolverConfig{
+		DoT:        "1.1.1.1",
+		Addresses:  []string{"1.1.1.1", "1.0.0.1"},
+		ServerName: "cloudflare-dns.com",
+		Cache: &dns.CacheConfig{
+			MaxEntries:     1000,
+			MaxTTL:         time.Hour,
+			MinNegativeTTL: 30 * time.Second,
+			NoNegative:     true,
+			TTLJitter:      0.1,
+			EDNSBufSize:    dns.DefaultEDNSBufSize,
+			Types:          []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA},
+		},
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatalf("Marshal(...) error = %v", err)
+	}
+	want := `{"dot":"1.1.1.1","addresses":["1.1.1.1","1.0.0.1"],"server_name":"cloudflare-dns.com",` +
+		`"cache":{"max_entries":1000,"max_ttl":"1h0m0s","min_negative_ttl":"30s","no_negative":true,` +
+		`"ttl_jitter":0.1,"edns_buf_size":1232,"types":[1,28]}}`
+	if string(data) != want {
+		t.Errorf("Marshal(...) = %s, wanted %s", data, want)
+	}
+
+	var got dns.ResolverConfig
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal(...) error = %v", err)
+	}
+	if !check(got, config) {
+		t.Errorf("Unmarshal(...) = %#v, wanted %#v", got, config)
+	}
+
+	if _, err := dns.NewResolver(got); err != nil {
+		t.Errorf("NewResolver(...) error = %v", err)
+	}
+}
+
+func TestResolver_Config(t *testing.T) {
+	dot, err := dns.NewDoTResolverWithClose("dns.example",
+		dns.DoTAddresses("192.0.2.1", "2001:db8::1"),
+		dns.DoTServerName("tls.example"),
+		dns.DoTCache(dns.MaxCacheTTL(5*time.Minute), dns.NegativeCache(false)))
+	if err != nil {
+		t.Fatalf("NewDoTResolverWithClose(...) error = %v", err)
+	}
+	defer dot.Close()
+
+	doh, err := dns.NewDoHResolverWithClose("https://dns.example/dns-query{?dns}",
+		dns.DoHAddresses("192.0.2.1:8443"))
+	if err != nil {
+		t.Fatalf("NewDoHResolverWithClose(...) error = %v", err)
+	}
+	defer doh.Close()
+
+	tests := []struct {
+		name string
+		r    *dns.Resolver
+		want dns.ResolverConfig
+	}{
+		{"DoT", dot, dns.ResolverConfig{
+			DoT:        "dns.example:853",
+			Addresses:  []string{"192.0.2.1:853", "[2001:db8::1]:853"},
+			ServerName: "tls.example",
+			Cache: &dns.CacheConfig{
+				MaxEntries: dns.DefaultMaxCacheEntries,
+				MaxTTL:     5 * time.Minute,
+				NoNegative: true,
+			},
+		}},
+		{"DoH", doh, dns.ResolverConfig{
+			DoH:       "https://dns.example/dns-query{?dns}",
+			Addresses: []string{"192.0.2.1:8443"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.r.Config()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Config() = %+v, want %+v", got, tt.want)
+			}
+
+			// the config is read-only
+			got.Addresses[0] = "192.0.2.2"
+			if tt.r.Config().Addresses[0] == "192.0.2.2" {
+				t.Error("Config() is not a copy")
+			}
+
+			// the config recreates the resolver
+			if _, err := dns.NewResolver(tt.r.Config()); err != nil {
+				t.Errorf("NewResolver(Config()) error = %v", err)
+			}
+		})
+	}
+}
+
+func TestNewResolver_invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		config dns.ResolverConfig
+	}{
+		{"Empty", dns.ResolverConfig{}},
+		{"Both", dns.ResolverConfig{DoT: "dns.google", DoH: "https://dns.google/dns-query"}},
+		{"ServerName", dns.ResolverConfig{DoH: "https://dns.google/dns-query", ServerName: "dns.google"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := dns.NewResolver(tt.config); err == nil {
+				t.Error("NewResolver(...) succeeded")
+			}
+			if _, err := json.Marshal(tt.config); err == nil {
+				t.Error("Marshal(...) succeeded")
+			}
+		})
+	}
+
+	var config dns.ResolverConfig
+	if err := json.Unmarshal([]byte(`{"dot":"dns.google","cache":{"max_ttl":"forever"}}`), &config); err == nil {
+		t.Error("Unmarshal(...) with invalid duration succeeded")
+	}
+}
+
+func TestNewResolverFromURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://1.1.1.1/dns-query", true},
+		{"https://1.1.1.1/dns-query{?dns}", true},
+		{"tls://1.1.1.1", true},
+		{"dot://1.1.1.1:853", true},
+		{"dns://1.1.1.1", true},
+		{"udp://[2606:4700:4700::1111]:53", true},
+		{"tcp://1.1.1.1", true},
+		{"1.1.1.1", false},
+		{"tls://", false},
+		{"udp://dns.google", false},
+		{"quic://1.1.1.1", false},
+		{"http://1.1.1.1/dns-query", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			_, err := dns.NewResolverFromURL(tt.url)
+			if (err == nil) != tt.valid {
+				t.Errorf("NewResolverFromURL(%q) error = %v", tt.url, err)
+			}
+		})
+	}
+
+	addr := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	r, err := dns.NewResolverFromURL("udp://" + addr)
+	if err != nil {
+		t.Fatalf("NewResolverFromURL(...) error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ips, err := r.LookupIPAddr(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("LookupIPAddr(...) error = %v", err)
+	}
+	if !checkIPAddrs(ips, "192.0.2.1") {
+		t.Errorf("LookupIPAddr(...) = %v", ips)
+	}
+}
@@ -3,13 +3,29 @@ package dns
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"math"
 	"net"
 	"strings"
 	"sync"
 	"time"
 )
 
+// dnsConn is a [net.Conn] that sends DNS messages with roundTrip.
+//
+// It is intentionally stream-only: it does not implement [net.PacketConn],
+// so the Go resolver always frames messages with a length prefix, as for TCP,
+// and never truncates large responses, whatever the transport.
+//
+// Queries are queued by Write until Read sends them.
+// The queue is bounded by maxQueue bytes, dnsConnMaxQueue by default:
+// writes that would exceed it fail, rather than block, since the queue is drained by Read,
+// typically on the same goroutine.
+//
+// Read sends all queued queries concurrently, up to pipelineWindow of them,
+// and returns responses as they arrive, so pipelined queries
+// (like those of [ExchangeBatch]) don't wait for each other.
 type dnsConn struct {
 	sync.Mutex
 
@@ -20,32 +36,143 @@ type dnsConn struct {
 	cancel    context.CancelFunc
 	deadline  time.Time
 	roundTrip roundTripper
+	maxQueue  int
+
+	// queries in flight, and their results
+	inflight int
+	results  []dnsResult
+	ready    chan struct{}
+}
+
+type dnsResult struct {
+	res string
+	err error
 }
 
 type roundTripper func(ctx context.Context, req string) (res string, err error)
 
 func (c *dnsConn) Read(b []byte) (n int, err error) {
-	imsg, n, err := c.drainBuffers(b)
-	if n != 0 || err != nil {
-		return n, err
+	for {
+		n, ready, err := c.dispatch(b)
+		if n != 0 || err != nil {
+			return n, err
+		}
+		<-ready
+	}
+}
+
+// dispatch returns buffered output, or the next result,
+// after sending queued queries.
+// If there's nothing to return yet, it returns a channel that's ready when there is.
+func (c *dnsConn) dispatch(b []byte) (int, <-chan struct{}, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	// drain the output buffer
+	if c.obuf.Len() > 0 {
+		n, err := c.obuf.Read(b)
+		return n, nil, err
+	}
+
+	// send queued queries
+	var err error
+	for c.inflight < pipelineWindow {
+		var msg string
+		msg, err = c.nextMessage()
+		if msg == "" || err != nil {
+			break
+		}
+		if c.ready == nil {
+			c.ready = make(chan struct{}, 1)
+		}
+		c.inflight++
+		go c.send(msg)
+	}
+
+	// return the next result
+	if len(c.results) > 0 {
+		r := c.results[0]
+		c.results = c.results[1:]
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		c.obuf.WriteByte(byte(len(r.res) >> 8))
+		c.obuf.WriteByte(byte(len(r.res)))
+		c.obuf.WriteString(r.res)
+		n, err := c.obuf.Read(b)
+		return n, nil, err
+	}
+	if c.inflight == 0 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return 0, c.ready, nil
+}
+
+// nextMessage removes the next message from the input buffer.
+// It returns an empty string if there are none.
+func (c *dnsConn) nextMessage() (string, error) {
+	buf := c.ibuf.Bytes()
+	if len(buf) == 0 {
+		return "", nil
+	}
+	if len(buf) < 2 {
+		return "", io.ErrUnexpectedEOF
 	}
+	size := int(buf[0])<<8 | int(buf[1])
+	if len(buf) < 2+size {
+		return "", io.ErrUnexpectedEOF
+	}
+	c.ibuf.Next(2)
+	return string(c.ibuf.Next(size)), nil
+}
 
+// send sends a query, and stores the result.
+func (c *dnsConn) send(imsg string) {
 	ctx, cancel := c.childContext()
 	omsg, err := c.roundTrip(ctx, imsg)
 	cancel()
-	if err != nil {
-		return 0, err
+	if err == nil && len(imsg) >= 2 && !strings.HasPrefix(omsg, imsg[:2]) {
+		err = errIDMismatch
+	}
+	if err == nil {
+		omsg = normalizeNoData(imsg, omsg)
 	}
 
-	return c.fillBuffer(b, omsg)
+	c.Lock()
+	c.results = append(c.results, dnsResult{omsg, err})
+	c.inflight--
+	c.Unlock()
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
 }
 
+var errIDMismatch = errors.New("dns: response ID mismatch")
+
 func (c *dnsConn) Write(b []byte) (n int, err error) {
 	c.Lock()
 	defer c.Unlock()
+	max := c.maxQueue
+	if max <= 0 {
+		max = dnsConnMaxQueue
+	}
+	if c.ibuf.Len()+len(b) > max {
+		return 0, errQueueFull
+	}
 	return c.ibuf.Write(b)
 }
 
+// dnsConnMaxQueue is the default bound of the query queue,
+// which fits a full pipeline of maximum size queries, see [ExchangeBatch].
+const dnsConnMaxQueue = pipelineWindow * (2 + math.MaxUint16)
+
+var errQueueFull = errors.New("dns: too many queued queries")
+
 func (c *dnsConn) Close() error {
 	c.Lock()
 	cancel := c.cancel
@@ -83,51 +210,70 @@ func (c *dnsConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
-func (c *dnsConn) drainBuffers(b []byte) (string, int, error) {
+func (c *dnsConn) childContext() (context.Context, context.CancelFunc) {
 	c.Lock()
 	defer c.Unlock()
-
-	// drain the output buffer
-	if c.obuf.Len() > 0 {
-		n, err := c.obuf.Read(b)
-		return "", n, err
+	if c.ctx == nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
 	}
-
-	// otherwise, get the next message from the input buffer
-	sz := c.ibuf.Next(2)
-	if len(sz) < 2 {
-		return "", 0, io.ErrUnexpectedEOF
+	if c.deadline.IsZero() {
+		// a zero deadline means no deadline
+		return context.WithCancel(c.ctx)
 	}
+	return context.WithDeadline(c.ctx, c.deadline)
+}
 
-	size := int64(sz[0])<<8 | int64(sz[1])
-
-	var str strings.Builder
-	_, err := io.CopyN(&str, &c.ibuf, size)
-	if err == io.EOF {
-		return "", 0, io.ErrUnexpectedEOF
+// dialConn dials a connection that is closed when ctx is done,
+// and has the deadline of ctx.
+func dialConn(ctx context.Context, dial DialFunc, network, address string) (net.Conn, context.CancelFunc, error) {
+	var conn net.Conn
+	var err error
+	if dial != nil {
+		conn, err = dial(ctx, network, address)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, network, address)
 	}
 	if err != nil {
-		return "", 0, err
+		return nil, nil, err
 	}
-	return str.String(), 0, nil
-}
 
-func (c *dnsConn) fillBuffer(b []byte, str string) (int, error) {
-	c.Lock()
-	defer c.Unlock()
-	c.obuf.WriteByte(byte(len(str) >> 8))
-	c.obuf.WriteByte(byte(len(str)))
-	c.obuf.WriteString(str)
-	return c.obuf.Read(b)
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if t, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(t)
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+	}
+	return conn, cancel, nil
 }
 
-func (c *dnsConn) childContext() (context.Context, context.CancelFunc) {
-	c.Lock()
-	defer c.Unlock()
-	if c.ctx == nil {
-		c.ctx, c.cancel = context.WithCancel(context.Background())
+// exchange sends a request through a new connection, and reads the response.
+func exchange(ctx context.Context, dial DialFunc, network, address string, req string) (string, error) {
+	conn, cancel, err := dialConn(ctx, dial, network, address)
+	if err != nil {
+		return "", err
 	}
-	return context.WithDeadline(c.ctx, c.deadline)
+	defer cancel()
+	if network == "unix" {
+		// stream sockets are framed like TCP
+		conn = struct{ net.Conn }{conn}
+	}
+
+	// send request
+	err = writeMessage(conn, req)
+	if err != nil {
+		return "", err
+	}
+
+	// read response
+	return readMessage(conn)
 }
 
 func writeMessage(conn net.Conn, msg string) error {
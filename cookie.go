@@ -0,0 +1,74 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+const (
+	ednsCookie     = 10 // EDNS COOKIE option code
+	rcodeBadCookie = 23 // BADCOOKIE extended RCODE
+)
+
+var errBadCookie = errors.New("dns: client cookie mismatch")
+
+// A cookieJar holds DNS cookies (RFC 7873), by server address.
+type cookieJar struct {
+	sync.Mutex
+	cookies map[string]cookie
+	rand    randFunc
+}
+
+type cookie struct {
+	client string
+	server string
+}
+
+func newCookieJar(rand randFunc) *cookieJar {
+	return &cookieJar{
+		cookies: map[string]cookie{},
+		rand:    rand,
+	}
+}
+
+func (j *cookieJar) get(addr string) cookie {
+	j.Lock()
+	defer j.Unlock()
+
+	c, ok := j.cookies[addr]
+	if !ok {
+		// a different client cookie for each server
+		var client [8]byte
+		binary.BigEndian.PutUint64(client[:], j.rand())
+		c.client = string(client[:])
+		j.cookies[addr] = c
+	}
+	return c
+}
+
+// attach adds the cookies for addr to req.
+func (j *cookieJar) attach(req, addr string) string {
+	c := j.get(addr)
+	return addEDNSOption(req, ednsCookie, c.client+c.server)
+}
+
+// check validates the client cookie echoed in res, and stores the server cookie.
+// Responses without cookies are accepted, as servers need not support them.
+func (j *cookieJar) check(res, addr string) error {
+	data, ok := getEDNSOption(res, ednsCookie)
+	if !ok {
+		return nil
+	}
+
+	c := j.get(addr)
+	if len(data) < 8 || data[:8] != c.client {
+		return errBadCookie
+	}
+	if server := data[8:]; 8 <= len(server) && len(server) <= 32 {
+		j.Lock()
+		j.cookies[addr] = cookie{client: c.client, server: server}
+		j.Unlock()
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ package dns
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"sync"
 	"time"
@@ -19,32 +20,188 @@ import (
 
 // OpportunisticResolver opportunistically tries encrypted DNS over TLS
 // using the local resolver.
-var OpportunisticResolver = &net.Resolver{
-	Dial:     opportunisticDial,
-	PreferGo: true,
+var OpportunisticResolver = NewOpportunisticResolver()
+
+// NewOpportunisticResolver creates a resolver like [OpportunisticResolver],
+// customized with the given options.
+func NewOpportunisticResolver(options ...OpportunisticOption) *net.Resolver {
+	return &net.Resolver{
+		Dial:     OpportunisticDialer(nil, options...),
+		PreferGo: true,
+	}
+}
+
+// OpportunisticDialer wraps dial to opportunistically try encrypted DNS over TLS,
+// like [OpportunisticResolver], falling back to dial when that isn't possible.
+// This allows composing opportunistic encryption with a custom dialer, like a proxy.
+// If dial is nil, the DialFunc set with [OpportunisticDialFunc] is used.
+func OpportunisticDialer(dial DialFunc, options ...OpportunisticOption) DialFunc {
+	opts := &opportunisticOpts{
+		threshold: 2 * time.Second,
+		sessions:  tls.NewLRUClientSessionCache(0),
+	}
+	for _, o := range options {
+		o.apply(opts)
+	}
+	if dial != nil {
+		opts.dialFunc = dial
+	}
+	if opts.addrs == nil {
+		return opts.dial
+	}
+
+	// dial the given servers, failing over between them
+	var addrs addrList
+	addrs.addrs, opts.err = normalizeAddrs(opts.addrs, "53")
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if opts.err != nil {
+			return nil, opts.err
+		}
+		conn, _, err := addrs.dial(ctx, opts.dial, network)
+		return conn, err
+	}
 }
 
-func opportunisticDial(ctx context.Context, network, address string) (net.Conn, error) {
+func (o *opportunisticOpts) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	dial := o.dialFunc
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	if o.tcp && network == "udp" {
+		// the resolver frames messages over stream connections
+		network = "tcp"
+	}
+
 	host, port, _ := net.SplitHostPort(address)
-	if (port == "53" || port == "domain") && notBadServer(address) {
-		deadline, ok := ctx.Deadline()
-		if ok && deadline.After(time.Now().Add(2*time.Second)) {
-			var d net.Dialer
-			d.Timeout = time.Second
-			tlsAddr := net.JoinHostPort(host, "853")
-			tlsConf := tls.Config{InsecureSkipVerify: true}
-			conn, _ := tls.DialWithDialer(&d, "tcp", tlsAddr, &tlsConf)
-			if conn != nil {
+	if port == "53" || port == "domain" {
+		_, upgraded := o.resumable.Load(host)
+		if o.strict && upgraded {
+			// never downgrade servers that supported encryption
+			if conn := o.dialTLS(ctx, dial, host, o.threshold); conn != nil {
 				return conn, nil
 			}
-			addBadServer(address)
+			return nil, errDowngrade
+		}
+
+		if notBadServer(address) {
+			// resumed sessions have faster handshakes
+			threshold := o.threshold
+			if upgraded {
+				threshold /= 2
+			}
+			deadline, ok := ctx.Deadline()
+			if ok && deadline.After(time.Now().Add(threshold)) {
+				if conn := o.dialTLS(ctx, dial, host, threshold/2); conn != nil {
+					return conn, nil
+				}
+				addBadServer(address)
+			}
 		}
 	}
 
-	var d net.Dialer
-	return d.DialContext(ctx, network, address)
+	return dial(ctx, network, address)
 }
 
+func (o *opportunisticOpts) dialTLS(ctx context.Context, dial DialFunc, host string, timeout time.Duration) net.Conn {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := dial(ctx, "tcp", net.JoinHostPort(host, "853"))
+	if err != nil {
+		return nil
+	}
+
+	// verify known servers
+	tlsConf := tls.Config{InsecureSkipVerify: true}
+	if name, ok := o.verify[host]; ok {
+		tlsConf = tls.Config{ServerName: name}
+	}
+	tlsConf.ClientSessionCache = o.sessions
+
+	tlsConn := tls.Client(conn, &tlsConf)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil
+	}
+	o.resumable.Store(host, struct{}{})
+	return tlsConn
+}
+
+// An OpportunisticOption customizes the opportunistic resolver.
+type OpportunisticOption interface {
+	apply(*opportunisticOpts)
+}
+
+type opportunisticOpts struct {
+	verify    map[string]string
+	dialFunc  DialFunc
+	threshold time.Duration
+	addrs     []string
+	err       error
+	strict    bool
+	tcp       bool
+
+	sessions  tls.ClientSessionCache
+	resumable sync.Map // hosts with successful handshakes
+}
+
+type (
+	opportunisticVerify    map[string]string
+	opportunisticDialFunc  DialFunc
+	opportunisticThreshold time.Duration
+	opportunisticAddresses []string
+	opportunisticStrict    struct{}
+	opportunisticTCP       struct{}
+)
+
+func (o opportunisticVerify) apply(t *opportunisticOpts)    { t.verify = o }
+func (o opportunisticDialFunc) apply(t *opportunisticOpts)  { t.dialFunc = (DialFunc)(o) }
+func (o opportunisticThreshold) apply(t *opportunisticOpts) { t.threshold = time.Duration(o) }
+func (o opportunisticAddresses) apply(t *opportunisticOpts) { t.addrs = ([]string)(o) }
+func (o opportunisticStrict) apply(t *opportunisticOpts)    { t.strict = true }
+func (o opportunisticTCP) apply(t *opportunisticOpts)       { t.tcp = true }
+
+// OpportunisticVerify maps resolver IP addresses to host names.
+// Encrypted connections to these resolvers verify their certificates against the host name;
+// connections to other resolvers remain unverified.
+func OpportunisticVerify(servers map[string]string) OpportunisticOption {
+	return opportunisticVerify(servers)
+}
+
+// OpportunisticDialFunc sets the DialFunc used to connect to the resolver,
+// both for encrypted and unencrypted DNS.
+// By default [net.Dialer.DialContext] is used.
+func OpportunisticDialFunc(f DialFunc) OpportunisticOption { return opportunisticDialFunc(f) }
+
+// OpportunisticThreshold sets the time left until a lookup's deadline
+// required to try encrypted DNS over TLS; the default is 2 seconds.
+// Half of it is allowed for the TLS handshake, before falling back to unencrypted DNS.
+// The threshold is halved for resolvers that had successful handshakes,
+// as resumed sessions are faster.
+func OpportunisticThreshold(d time.Duration) OpportunisticOption { return opportunisticThreshold(d) }
+
+// OpportunisticAddresses sets the servers used by the resolver, instead of the system's.
+// These must be IP addresses, or network addresses of the form "IP:port".
+// Servers are tried in order, failing over to the next one when dialing fails.
+// Invalid addresses make every lookup fail.
+func OpportunisticAddresses(addresses ...string) OpportunisticOption {
+	return opportunisticAddresses(addresses)
+}
+
+// OpportunisticStrict pins encryption for resolvers that supported it (trust on first use):
+// once a TLS handshake with a resolver succeeds, lookups using it fail
+// if encrypted DNS fails, instead of falling back to unencrypted DNS.
+// This protects against downgrade attacks that block DNS over TLS.
+func OpportunisticStrict() OpportunisticOption { return opportunisticStrict{} }
+
+// OpportunisticForceTCP makes unencrypted DNS use TCP, even when UDP is requested,
+// which avoids fragmentation and off-path spoofing.
+// Encrypted DNS over TLS is still tried first, as it also uses TCP.
+func OpportunisticForceTCP() OpportunisticOption { return opportunisticTCP{} }
+
+var errDowngrade = errors.New("dns: refusing to downgrade to unencrypted DNS")
+
 var badServers struct {
 	sync.Mutex
 	next int
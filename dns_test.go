@@ -1,8 +1,28 @@
 package dns_test
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/ncruces/go-dns"
 )
 
 func check(a, b any) bool {
@@ -26,3 +46,652 @@ func checkIPAddrs(got []net.IPAddr, wanted ...string) bool {
 
 	return check(a, b)
 }
+
+func TestOpportunisticVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		verify bool
+		want   string
+	}{
+		{"Unverified", false, ""},
+		{"Verified", true, "dns.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// failing servers are remembered, so use a new address each time
+			host := fmt.Sprintf("192.0.2.%d", opportunisticHost.Add(1))
+			address := net.JoinHostPort(host, "53")
+			verify := map[string]string{}
+			if tt.verify {
+				verify[host] = "dns.example"
+			}
+
+			// record the SNI sent by the client, then fail the handshake
+			sni := make(chan string, 1)
+			config := &tls.Config{
+				GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					sni <- hello.ServerName
+					return nil, errors.New("handshake rejected")
+				},
+			}
+			var plain []string
+			dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+				if network != "tcp" {
+					plain = append(plain, address)
+					return nil, errors.New("unreachable")
+				}
+				client, server := net.Pipe()
+				go func() {
+					defer server.Close()
+					tls.Server(server, config).Handshake()
+				}()
+				return client, nil
+			}
+
+			r := dns.NewOpportunisticResolver(
+				dns.OpportunisticVerify(verify),
+				dns.OpportunisticDialFunc(dial))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// falls back to unencrypted DNS
+			r.Dial(ctx, "udp", address)
+			select {
+			case got := <-sni:
+				if got != tt.want {
+					t.Errorf("ServerName = %q, wanted %q", got, tt.want)
+				}
+			default:
+				t.Error("no TLS handshake")
+			}
+			if !check(plain, []string{address}) {
+				t.Errorf("dialed %v, wanted %v", plain, address)
+			}
+		})
+	}
+}
+
+var opportunisticHost atomic.Int32
+
+func TestOpportunisticDialer(t *testing.T) {
+	var dialed []string
+	dial := dns.OpportunisticDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		if _, port, _ := net.SplitHostPort(address); port == "853" {
+			return nil, errors.New("unreachable")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+
+	// upgrade fails, falls back to unencrypted DNS
+	host := fmt.Sprintf("192.0.2.%d", opportunisticHost.Add(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := dial(ctx, "udp", net.JoinHostPort(host, "53"))
+	if err != nil {
+		t.Fatalf("dial(...) error = %v", err)
+	}
+	conn.Close()
+
+	want := []string{"tcp " + host + ":853", "udp " + host + ":53"}
+	if !check(dialed, want) {
+		t.Errorf("dialed %v, wanted %v", dialed, want)
+	}
+
+	// failed upgrades are remembered
+	dialed = nil
+	conn, err = dial(ctx, "udp", net.JoinHostPort(host, "53"))
+	if err != nil {
+		t.Fatalf("dial(...) error = %v", err)
+	}
+	conn.Close()
+
+	want = []string{"udp " + host + ":53"}
+	if !check(dialed, want) {
+		t.Errorf("dialed %v, wanted %v", dialed, want)
+	}
+
+	// other ports are not upgraded
+	dialed = nil
+	conn, err = dial(ctx, "tcp", "192.0.2.1:5353")
+	if err != nil {
+		t.Fatalf("dial(...) error = %v", err)
+	}
+	conn.Close()
+
+	want = []string{"tcp 192.0.2.1:5353"}
+	if !check(dialed, want) {
+		t.Errorf("dialed %v, wanted %v", dialed, want)
+	}
+}
+
+func TestOpportunisticThreshold(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+	config := &tls.Config{Certificates: srv.TLS.Certificates}
+
+	var encrypted, plain atomic.Int32
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		if network == "tcp" {
+			encrypted.Add(1)
+			go func() {
+				defer server.Close()
+				conn := tls.Server(server, config)
+				if conn.Handshake() == nil {
+					io.Copy(io.Discard, conn)
+				}
+			}()
+		} else {
+			plain.Add(1)
+			server.Close()
+		}
+		return client, nil
+	}
+
+	r := dns.NewOpportunisticResolver(dns.OpportunisticDialFunc(dial))
+	address := fmt.Sprintf("192.0.2.%d:53", opportunisticHost.Add(1))
+
+	lookup := func(timeout time.Duration) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		conn, err := r.Dial(ctx, "udp", address)
+		if err != nil {
+			t.Fatalf("Dial(...) error = %v", err)
+		}
+		conn.Close()
+	}
+
+	// not enough time for a handshake
+	lookup(1500 * time.Millisecond)
+	if e, p := encrypted.Load(), plain.Load(); e != 0 || p != 1 {
+		t.Errorf("got %d encrypted and %d plain connections", e, p)
+	}
+
+	lookup(5 * time.Second)
+	if e, p := encrypted.Load(), plain.Load(); e != 1 || p != 1 {
+		t.Errorf("got %d encrypted and %d plain connections", e, p)
+	}
+
+	// enough time for a resumed handshake
+	lookup(1500 * time.Millisecond)
+	if e, p := encrypted.Load(), plain.Load(); e != 2 || p != 1 {
+		t.Errorf("got %d encrypted and %d plain connections", e, p)
+	}
+}
+
+func TestOpportunisticStrict(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+	config := &tls.Config{Certificates: srv.TLS.Certificates}
+
+	var blocked atomic.Bool
+	var encrypted, plain atomic.Int32
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		if network == "tcp" {
+			if blocked.Load() {
+				server.Close()
+				return nil, errors.New("blocked")
+			}
+			encrypted.Add(1)
+			go func() {
+				defer server.Close()
+				conn := tls.Server(server, config)
+				if conn.Handshake() == nil {
+					io.Copy(io.Discard, conn)
+				}
+			}()
+		} else {
+			plain.Add(1)
+			server.Close()
+		}
+		return client, nil
+	}
+
+	tests := []struct {
+		name   string
+		strict bool
+		plain  int32
+	}{
+		{"Default", false, 1},
+		{"Strict", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocked.Store(false)
+			encrypted.Store(0)
+			plain.Store(0)
+
+			options := []dns.OpportunisticOption{dns.OpportunisticDialFunc(dial)}
+			if tt.strict {
+				options = append(options, dns.OpportunisticStrict())
+			}
+			r := dns.NewOpportunisticResolver(options...)
+			address := fmt.Sprintf("192.0.2.%d:53", opportunisticHost.Add(1))
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, err := r.Dial(ctx, "udp", address)
+			if err != nil {
+				t.Fatalf("Dial(...) error = %v", err)
+			}
+			conn.Close()
+			if e := encrypted.Load(); e != 1 {
+				t.Fatalf("got %d encrypted connections", e)
+			}
+
+			// encryption is blocked
+			blocked.Store(true)
+			conn, err = r.Dial(ctx, "udp", address)
+			if tt.strict == (err == nil) {
+				t.Errorf("Dial(...) error = %v", err)
+			}
+			if err == nil {
+				conn.Close()
+			}
+			if p := plain.Load(); p != tt.plain {
+				t.Errorf("got %d plain connections, wanted %d", p, tt.plain)
+			}
+		})
+	}
+}
+
+func TestOpportunisticForceTCP(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+	config := &tls.Config{Certificates: srv.TLS.Certificates}
+
+	var blocked atomic.Bool
+	var network atomic.Value
+	dial := func(ctx context.Context, n, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		if strings.HasSuffix(address, ":853") {
+			if blocked.Load() {
+				server.Close()
+				return nil, errors.New("blocked")
+			}
+			go func() {
+				defer server.Close()
+				conn := tls.Server(server, config)
+				if conn.Handshake() == nil {
+					io.Copy(io.Discard, conn)
+				}
+			}()
+		} else {
+			network.Store(n)
+			server.Close()
+		}
+		return client, nil
+	}
+
+	r := dns.NewOpportunisticResolver(dns.OpportunisticDialFunc(dial), dns.OpportunisticForceTCP())
+	address := fmt.Sprintf("192.0.2.%d:53", opportunisticHost.Add(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// encryption is layered on TCP
+	conn, err := r.Dial(ctx, "udp", address)
+	if err != nil {
+		t.Fatalf("Dial(...) error = %v", err)
+	}
+	conn.Close()
+	if _, ok := conn.(*tls.Conn); !ok {
+		t.Errorf("got %T, wanted a TLS connection", conn)
+	}
+
+	// unencrypted DNS uses TCP
+	blocked.Store(true)
+	conn, err = r.Dial(ctx, "udp", address)
+	if err != nil {
+		t.Fatalf("Dial(...) error = %v", err)
+	}
+	conn.Close()
+	if got := network.Load(); got != "tcp" {
+		t.Errorf("got network %v, wanted tcp", got)
+	}
+}
+
+func TestOpportunisticAddresses(t *testing.T) {
+	first := fmt.Sprintf("192.0.2.%d", opportunisticHost.Add(1))
+	second := fmt.Sprintf("192.0.2.%d:5353", opportunisticHost.Add(1))
+
+	var dialed []string
+	dial := dns.OpportunisticDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		if host, _, _ := net.SplitHostPort(address); host == first {
+			return nil, errors.New("unreachable")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}, dns.OpportunisticAddresses(first, second))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the system's server is ignored, and the first server fails over
+	conn, err := dial(ctx, "udp", "127.0.0.53:53")
+	if err != nil {
+		t.Fatalf("dial(...) error = %v", err)
+	}
+	conn.Close()
+
+	want := []string{"tcp " + first + ":853", "udp " + first + ":53", "udp " + second}
+	if !check(dialed, want) {
+		t.Errorf("dialed %v, wanted %v", dialed, want)
+	}
+
+	dial = dns.OpportunisticDialer(nil, dns.OpportunisticAddresses("localhost"))
+	if _, err := dial(ctx, "udp", "127.0.0.53:53"); err == nil {
+		t.Error("dial(...) with invalid address succeeded")
+	}
+}
+
+func TestOpportunisticAddresses_network(t *testing.T) {
+	ipv4 := fmt.Sprintf("192.0.2.%d:53", opportunisticHost.Add(1))
+	ipv6 := fmt.Sprintf("[2001:db8::%d]:53", opportunisticHost.Add(1))
+
+	var dialed []string
+	record := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	dial := dns.OpportunisticDialer(record, dns.OpportunisticAddresses(ipv6, ipv4))
+
+	// without a deadline, encryption isn't tried
+	ctx := context.Background()
+
+	tests := []struct {
+		network string
+		want    string
+	}{
+		{"udp", "udp " + ipv6},
+		{"udp4", "udp4 " + ipv4},
+		{"tcp4", "tcp4 " + ipv4},
+		{"udp6", "udp6 " + ipv6},
+		{"tcp6", "tcp6 " + ipv6},
+	}
+	for _, tt := range tests {
+		dialed = nil
+		conn, err := dial(ctx, tt.network, "127.0.0.53:53")
+		if err != nil {
+			t.Fatalf("dial(%q) error = %v", tt.network, err)
+		}
+		conn.Close()
+		if !check(dialed, []string{tt.want}) {
+			t.Errorf("dial(%q) dialed %v, wanted %v", tt.network, dialed, tt.want)
+		}
+	}
+
+	// no addresses in the family
+	dial = dns.OpportunisticDialer(record, dns.OpportunisticAddresses(ipv4))
+	if _, err := dial(ctx, "udp6", "127.0.0.53:53"); err == nil {
+		t.Error("dial(\"udp6\") succeeded")
+	}
+}
+
+// pipeDial returns a dial function that answers queries in memory, using handler.
+func pipeDial(handler func(req dnsmessage.Message) dnsmessage.Message) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go serveConn(server, handler)
+		return client, nil
+	}
+}
+
+// serveConn answers the queries read from a stream conn using handler,
+// until the conn is closed.
+func serveConn(conn net.Conn, handler func(req dnsmessage.Message) dnsmessage.Message) {
+	// write responses asynchronously, to allow pipelining
+	responses := make(chan []byte, 64)
+	go func() {
+		defer conn.Close()
+		for res := range responses {
+			if _, err := conn.Write(res); err != nil {
+				return
+			}
+		}
+	}()
+
+	defer close(responses)
+	for {
+		var sz [2]byte
+		if _, err := io.ReadFull(conn, sz[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(sz[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+
+		var req dnsmessage.Message
+		if err := req.Unpack(msg); err != nil {
+			return
+		}
+		res := handler(req)
+		out, err := res.AppendPack([]byte{0, 0})
+		if err != nil {
+			return
+		}
+		binary.BigEndian.PutUint16(out, uint16(len(out)-2))
+		responses <- out
+	}
+}
+
+// udpServer starts a DNS over UDP server that answers queries using handler,
+// and returns its address.
+func udpServer(t testing.TB, handler func(req dnsmessage.Message) dnsmessage.Message) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var req dnsmessage.Message
+			if err := req.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			res := handler(req)
+			out, err := res.Pack()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(out, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// dohHandler returns an HTTP handler that answers DoH GET and POST queries, using handler.
+func dohHandler(handler func(req dnsmessage.Message) dnsmessage.Message) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body []byte
+		var err error
+		if r.Method == http.MethodGet {
+			body, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			body, err = io.ReadAll(r.Body)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var req dnsmessage.Message
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res := handler(req)
+		out, err := res.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out)
+	})
+}
+
+// answer builds a response to req with the given TTL and IP addresses.
+// With no addresses, the response is a name error.
+func answer(req dnsmessage.Message, ttl uint32, ips ...string) dnsmessage.Message {
+	res := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 req.ID,
+			Response:           true,
+			RecursionDesired:   req.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: req.Questions,
+	}
+	if len(ips) == 0 {
+		res.RCode = dnsmessage.RCodeNameError
+	}
+
+	q := req.Questions[0]
+	for _, ip := range ips {
+		addr := netip.MustParseAddr(ip)
+		hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: q.Class, TTL: ttl}
+		switch {
+		case addr.Is4() && q.Type == dnsmessage.TypeA:
+			hdr.Type = dnsmessage.TypeA
+			res.Answers = append(res.Answers, dnsmessage.Resource{
+				Header: hdr, Body: &dnsmessage.AResource{A: addr.As4()}})
+		case addr.Is6() && q.Type == dnsmessage.TypeAAAA:
+			hdr.Type = dnsmessage.TypeAAAA
+			res.Answers = append(res.Answers, dnsmessage.Resource{
+				Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	if len(res.Answers) == 0 {
+		// negative responses are cacheable for the SOA MINIMUM (RFC 2308)
+		hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSOA, Class: q.Class, TTL: ttl}
+		res.Authorities = append(res.Authorities, dnsmessage.Resource{
+			Header: hdr, Body: &dnsmessage.SOAResource{NS: q.Name, MBox: q.Name, MinTTL: ttl}})
+	}
+	return res
+}
+
+// testTLS returns server and client TLS configs,
+// for a self-signed certificate valid for "example.com" and 127.0.0.1.
+func testTLS(t testing.TB) (server, client *tls.Config) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	server = &tls.Config{Certificates: srv.TLS.Certificates}
+	client = &tls.Config{RootCAs: roots, ServerName: "example.com"}
+	return server, client
+}
+
+// dotServer starts a DNS over TLS server on 127.0.0.1 that answers queries using handler,
+// and returns its address, and a client TLS config that trusts it, see [testTLS].
+func dotServer(t testing.TB, handler func(req dnsmessage.Message) dnsmessage.Message) (string, *tls.Config) {
+	server, client := testTLS(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, handler)
+		}
+	}()
+	return ln.Addr().String(), client
+}
+
+// dohServer starts a DNS over HTTPS server on 127.0.0.1 that answers queries using handler.
+// Its URL, address and client transport can be used to create a resolver.
+func dohServer(t testing.TB, handler func(req dnsmessage.Message) dnsmessage.Message) *httptest.Server {
+	srv := httptest.NewTLSServer(dohHandler(handler))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// A testZone answers queries with canned responses, see [testZone.handler].
+type testZone struct {
+	sync.Mutex
+	hosts  map[string][]string
+	rcodes map[string]dnsmessage.RCode
+	tc     map[string]bool
+}
+
+func newTestZone() *testZone {
+	return &testZone{
+		hosts:  map[string][]string{},
+		rcodes: map[string]dnsmessage.RCode{},
+		tc:     map[string]bool{},
+	}
+}
+
+// addHost maps the fully qualified name to IP addresses.
+func (z *testZone) addHost(name string, ips ...string) {
+	z.Lock()
+	defer z.Unlock()
+	z.hosts[name] = append(z.hosts[name], ips...)
+}
+
+// setRCode makes queries for name fail with rcode, like SERVFAIL.
+func (z *testZone) setRCode(name string, rcode dnsmessage.RCode) {
+	z.Lock()
+	defer z.Unlock()
+	z.rcodes[name] = rcode
+}
+
+// setTruncated makes responses for name truncated.
+func (z *testZone) setTruncated(name string) {
+	z.Lock()
+	defer z.Unlock()
+	z.tc[name] = true
+}
+
+// handler answers queries from the zone.
+// Unknown names are NXDOMAIN; known names without records of the queried type are NODATA.
+func (z *testZone) handler(req dnsmessage.Message) dnsmessage.Message {
+	z.Lock()
+	defer z.Unlock()
+
+	name := req.Questions[0].Name.String()
+	ips, ok := z.hosts[name]
+	res := answer(req, 60, ips...)
+	if ok {
+		res.RCode = dnsmessage.RCodeSuccess
+	}
+	if rcode, ok := z.rcodes[name]; ok {
+		res.RCode = rcode
+		res.Answers = nil
+	}
+	if z.tc[name] {
+		res.Truncated = true
+		res.Answers = nil
+	}
+	return res
+}
@@ -2,54 +2,112 @@ package dns
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/netip"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
 // NewDoHResolver creates a DNS over HTTPS resolver.
-// The uri may be an URI Template.
+// The uri may be an URI Template (RFC 6570, up to level 3), like "https://dns.example/dns-query{?dns}".
+// The "dns" variable is bound to the query for GET requests; see [DoHTemplateVars] for other variables.
 func NewDoHResolver(uri string, options ...DoHOption) (*net.Resolver, error) {
-	// parse the uri template into a url
-	uri, err := parseURITemplate(uri)
-	if err != nil {
-		return nil, err
-	}
-	url, err := url.Parse(uri)
+	return NewDoHResolverContext(context.Background(), uri, options...)
+}
+
+// NewDoHResolverContext is like [NewDoHResolver],
+// but uses ctx to resolve the server's network addresses.
+func NewDoHResolverContext(ctx context.Context, uri string, options ...DoHOption) (*net.Resolver, error) {
+	r, err := newDoHResolver(ctx, uri, options...)
 	if err != nil {
 		return nil, err
 	}
-	port := url.Port()
-	if port == "" {
-		port = url.Scheme
-	}
+	return r.Resolver, nil
+}
+
+// NewDoHResolverWithClose is like [NewDoHResolver],
+// but returns a [Resolver] that can be closed.
+func NewDoHResolverWithClose(uri string, options ...DoHOption) (*Resolver, error) {
+	return newDoHResolver(context.Background(), uri, options...)
+}
 
+func newDoHResolver(ctx context.Context, uri string, options ...DoHOption) (*Resolver, error) {
 	// apply options
 	var opts dohOpts
 	for _, o := range options {
 		o.apply(&opts)
 	}
 
+	// parse the uri template into a url
+	tmpl, err := parseURITemplate(uri)
+	if err != nil {
+		return nil, err
+	}
+	base := tmpl.expand(opts.vars)
+	url, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+
+	// check the scheme
+	var port string
+	switch {
+	case url.Scheme == "https":
+		port = "443"
+	case url.Scheme == "http" && opts.insecure:
+		port = "80"
+	default:
+		return nil, fmt.Errorf("uri: unsupported scheme %q", url.Scheme)
+	}
+	if p := url.Port(); p != "" {
+		port = p
+	}
+
 	// resolve server network addresses
-	if len(opts.addrs) == 0 {
-		ips, err := OpportunisticResolver.LookupIPAddr(context.Background(), url.Hostname())
-		if err != nil {
-			return nil, err
+	var addrs addrList
+	if addrs.addrs, err = normalizeAddrs(opts.addrs, port); err != nil {
+		return nil, err
+	}
+	addrs.rand = randFunc(opts.rand)
+	addrs.setWeights(opts.weights)
+	addrs.latency = opts.latency
+	if opts.backoff == nil {
+		addrs.setBackoff(dohDialBackoff, dohMaxDialBackoff)
+	} else if opts.backoff[0] > 0 {
+		addrs.setBackoff(opts.backoff[0], opts.backoff[1])
+	}
+	if len(addrs.addrs) == 0 && opts.noLookup {
+		// only IP addresses don't need resolving
+		if _, err := netip.ParseAddr(url.Hostname()); err != nil {
+			return nil, errNoAddresses
 		}
-		opts.addrs = make([]string, len(ips))
-		for i, ip := range ips {
-			opts.addrs[i] = net.JoinHostPort(ip.String(), port)
+		addrs.addrs = []string{net.JoinHostPort(url.Hostname(), port)}
+	}
+	if len(addrs.addrs) == 0 {
+		lookup := func(ctx context.Context) ([]string, error) {
+			return lookupAddrs(ctx, url.Hostname(), port)
 		}
-	} else {
-		for i, a := range opts.addrs {
-			if net.ParseIP(a) != nil {
-				opts.addrs[i] = net.JoinHostPort(a, port)
-			}
+		if opts.lazy {
+			addrs.lookup = lookup
+		} else if addrs.addrs, err = lookup(ctx); err != nil {
+			return nil, err
 		}
 	}
 
@@ -61,43 +119,99 @@ func NewDoHResolver(uri string, options ...DoHOption) (*net.Resolver, error) {
 			TLSHandshakeTimeout: 10 * time.Second,
 			ForceAttemptHTTP2:   true,
 		}
+		if opts.maxIdle > 0 {
+			opts.transport.MaxIdleConns = opts.maxIdle
+			opts.transport.MaxIdleConnsPerHost = opts.maxIdle
+		}
+		if opts.idleTime > 0 {
+			opts.transport.IdleConnTimeout = opts.idleTime
+		}
 	} else {
 		opts.transport = opts.transport.Clone()
 	}
+	if opts.proxy != nil {
+		opts.transport.Proxy = opts.proxy
+	}
+	if opts.persistent {
+		opts.transport.MaxConnsPerHost = 1
+		opts.transport.MaxIdleConnsPerHost = 1
+		opts.transport.IdleConnTimeout = 0
+		opts.transport.ForceAttemptHTTP2 = true
+		// ping the idle connection, so a dead one is replaced
+		if h2, err := http2.ConfigureTransports(opts.transport); err == nil {
+			h2.ReadIdleTimeout = dohReadIdleTimeout
+		}
+	}
 
 	// setup the http client
-	client := http.Client{
-		Transport: opts.transport,
+	client := &dohClient{uri: base, onResponse: opts.onResponse}
+	client.method = opts.method
+	if tmpl.has("dns") {
+		client.tmpl = tmpl
+		client.vars = opts.vars
+	}
+	client.maxURL = opts.maxURL
+	if client.maxURL == 0 {
+		client.maxURL = dohMaxURLLength
+	}
+	if opts.metrics != nil {
+		client.metrics = opts.metrics
+		client.trace = opts.metrics.trace()
+	}
+	client.Transport = opts.transport
+	if opts.h2c && url.Scheme == "http" {
+		h2c := &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return opts.transport.DialContext(ctx, network, addr)
+			},
+		}
+		if opts.persistent {
+			h2c.ReadIdleTimeout = dohReadIdleTimeout
+		}
+		client.Transport = h2c
 	}
 
 	// create the resolver
 	var resolver = net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			conn := &dnsConn{}
-			conn.roundTrip = dohRoundTrip(uri, &client)
+			conn := &dnsConn{maxQueue: opts.maxQueue}
+			conn.roundTrip = client.roundTrip
 			return conn, nil
 		},
 	}
 
 	// setup dialer
-	var index atomic.Uint32
 	opts.transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
 		var d net.Dialer
-		i := index.Load()
-		conn, err := d.DialContext(ctx, network, opts.addrs[i])
+		// dial proxies directly
+		if host, _, _ := net.SplitHostPort(address); host != url.Hostname() {
+			return d.DialContext(ctx, network, address)
+		}
+
+		conn, addr, err := addrs.dial(ctx, d.DialContext, network)
 		if err != nil {
-			index.CompareAndSwap(i, (i+1)%uint32(len(opts.addrs)))
+			return nil, err
+		}
+		if opts.onUpstream != nil {
+			opts.onUpstream(network, addr)
 		}
-		return conn, err
+		return addrs.measure(conn, addr), nil
 	}
 
 	// setup caching
 	if opts.cache {
-		resolver.Dial = NewCachingDialer(resolver.Dial, opts.cacheOpts...)
+		resolver.Dial = NewCachingDialer(resolver.Dial, withMaxQueue(opts.cacheOpts, opts.maxQueue)...)
+		resolver.StrictErrors = strictErrors(opts.cacheOpts, false)
 	}
 
-	return &resolver, nil
+	res := newResolver(&resolver, &addrs, client.CloseIdleConnections)
+	res.conf = ResolverConfig{DoH: uri, Addresses: append([]string(nil), addrs.addrs...)}
+	if opts.cache {
+		res.conf.Cache = cacheConfig(opts.cacheOpts)
+	}
+	return res, nil
 }
 
 // A DoHOption customizes the DNS over HTTPS resolver.
@@ -106,86 +220,668 @@ type DoHOption interface {
 }
 
 type dohOpts struct {
-	transport *http.Transport
-	addrs     []string
-	cache     bool
-	cacheOpts []CacheOption
+	transport  *http.Transport
+	addrs      []string
+	weights    []int
+	cache      bool
+	cacheOpts  []CacheOption
+	proxy      func(*http.Request) (*url.URL, error)
+	lazy       bool
+	insecure   bool
+	h2c        bool
+	onUpstream func(network, address string)
+	persistent bool
+	onResponse func(*http.Response)
+	metrics    *DoHMetrics
+	maxIdle    int
+	idleTime   time.Duration
+	backoff    *[2]time.Duration
+	noLookup   bool
+	latency    bool
+	method     DoHMethod
+	maxURL     int
+	vars       map[string]string
+	rand       RandSource
+	maxQueue   int
 }
 
 type (
-	dohTransport http.Transport
-	dohAddresses []string
-	dohCache     []CacheOption
+	dohTransport  http.Transport
+	dohAddresses  []string
+	dohWeighted   map[string]int
+	dohCache      []CacheOption
+	dohProxy      func(*http.Request) (*url.URL, error)
+	dohLazy       struct{}
+	dohInsecure   struct{}
+	dohH2C        struct{}
+	dohOnUpstream func(network, address string)
+	dohPersistent struct{}
+	dohResponse   func(*http.Response)
+	dohMetrics    struct{ *DoHMetrics }
+	dohMaxIdle    int
+	dohIdleTime   time.Duration
+	dohBackoff    [2]time.Duration
+	dohNoBoot     struct{}
+	dohLatency    struct{}
+	dohMethod     DoHMethod
+	dohMaxURL     int
+	dohVars       map[string]string
+	dohRand       RandSource
+	dohMaxQueue   int
 )
 
 func (o *dohTransport) apply(t *dohOpts) { t.transport = (*http.Transport)(o) }
-func (o dohAddresses) apply(t *dohOpts)  { t.addrs = ([]string)(o) }
+func (o dohAddresses) apply(t *dohOpts)  { t.addrs = ([]string)(o); t.weights = nil }
+func (o dohWeighted) apply(t *dohOpts)   { t.addrs, t.weights = weightedAddrs(o) }
 func (o dohCache) apply(t *dohOpts)      { t.cache = true; t.cacheOpts = ([]CacheOption)(o) }
+func (o dohProxy) apply(t *dohOpts)      { t.proxy = o }
+func (o dohLazy) apply(t *dohOpts)       { t.lazy = true }
+func (o dohInsecure) apply(t *dohOpts)   { t.insecure = true }
+func (o dohH2C) apply(t *dohOpts)        { t.h2c = true }
+func (o dohOnUpstream) apply(t *dohOpts) { t.onUpstream = o }
+func (o dohPersistent) apply(t *dohOpts) { t.persistent = true }
+func (o dohResponse) apply(t *dohOpts)   { t.onResponse = o }
+func (o dohMetrics) apply(t *dohOpts)    { t.metrics = o.DoHMetrics }
+func (o dohMaxIdle) apply(t *dohOpts)    { t.maxIdle = int(o) }
+func (o dohIdleTime) apply(t *dohOpts)   { t.idleTime = time.Duration(o) }
+func (o dohBackoff) apply(t *dohOpts)    { t.backoff = (*[2]time.Duration)(&o) }
+func (o dohNoBoot) apply(t *dohOpts)     { t.noLookup = true }
+func (o dohLatency) apply(t *dohOpts)    { t.latency = true }
+func (o dohMethod) apply(t *dohOpts)     { t.method = DoHMethod(o) }
+func (o dohMaxURL) apply(t *dohOpts)     { t.maxURL = int(o) }
+func (o dohVars) apply(t *dohOpts)       { t.vars = o }
+func (o dohRand) apply(t *dohOpts)       { t.rand = RandSource(o) }
+func (o dohMaxQueue) apply(t *dohOpts)   { t.maxQueue = int(o) }
 
 // DoHTransport sets the http.Transport used by the resolver.
 func DoHTransport(transport *http.Transport) DoHOption { return (*dohTransport)(transport) }
 
 // DoHAddresses sets the network addresses of the resolver.
-// These should be IP addresses, or network addresses of the form "IP:port".
+// These must be IP addresses, or network addresses of the form "IP:port".
 // This avoids having to resolve the resolver's addresses, improving performance and privacy.
 func DoHAddresses(addresses ...string) DoHOption { return dohAddresses(addresses) }
 
+// DoHWeightedAddresses is like [DoHAddresses], but selects an address at random for each connection,
+// in proportion to its weight, instead of failing over in order.
+// Addresses that fail are avoided until all of them have failed.
+func DoHWeightedAddresses(addresses map[string]int) DoHOption { return dohWeighted(addresses) }
+
 // DoHCache adds caching to the resolver, with the given options.
 func DoHCache(options ...CacheOption) DoHOption { return dohCache(options) }
 
-func dohRoundTrip(uri string, client *http.Client) roundTripper {
-	return func(ctx context.Context, msg string) (string, error) {
-		// prepare request
-		req, err := http.NewRequestWithContext(ctx,
-			http.MethodPost, uri, strings.NewReader(msg))
-		if err != nil {
-			return "", err
-		}
-		req.Header.Set("Content-Type", "application/dns-message")
+// DoHProxy sets the proxy function used by the resolver's http.Transport,
+// like [http.ProxyFromEnvironment]. By default no proxy is used.
+func DoHProxy(proxy func(*http.Request) (*url.URL, error)) DoHOption { return dohProxy(proxy) }
+
+// DoHRand sets the source of randomness used to select among [DoHWeightedAddresses],
+// and to jitter the delay between dial attempts, see [RandSource].
+func DoHRand(f RandSource) DoHOption { return dohRand(f) }
+
+// DoHMaxQueue sets the maximum size, in bytes, of the queries queued on a connection to the resolver,
+// before they're sent; writes over it fail.
+// By default, the queue fits a full [ExchangeBatch] of maximum size queries.
+func DoHMaxQueue(size int) DoHOption { return dohMaxQueue(size) }
+
+// DoHLatencyAware selects the fastest address for each connection, instead of failing over in order.
+// Latency is a moving average of the round-trip time of requests to each address,
+// and is reported by [Resolver.Upstreams].
+// Addresses that fail are avoided until all of them have failed.
+func DoHLatencyAware() DoHOption { return dohLatency{} }
+
+// DoHLazyBootstrap defers resolving the server's network addresses until the first query.
+// Addresses are resolved again if all of them fail.
+// This allows creating the resolver before the network is up.
+func DoHLazyBootstrap() DoHOption { return dohLazy{} }
+
+// DoHNoBootstrap never resolves the server's network addresses,
+// so that queries can't leak to the resolver used for bootstrapping.
+// Addresses must then be set with [DoHAddresses], unless the URI host is an IP address;
+// otherwise, creating the resolver fails.
+func DoHNoBootstrap() DoHOption { return dohNoBoot{} }
+
+// DoHRequestMethod sets the HTTP method used to send queries; the default is [DoHPost].
+func DoHRequestMethod(m DoHMethod) DoHOption { return dohMethod(m) }
+
+// DoHMaxURLLength sets the maximum URL length of GET requests sent with [DoHAuto];
+// the default is 2048 bytes.
+func DoHMaxURLLength(n int) DoHOption { return dohMaxURL(n) }
+
+// DoHTemplateVars sets the values of variables in the URI Template, other than "dns".
+// Undefined variables are omitted when the template is expanded.
+func DoHTemplateVars(vars map[string]string) DoHOption { return dohVars(vars) }
+
+// A DoHMethod is an HTTP method used to send DNS over HTTPS queries.
+type DoHMethod int
+
+const (
+	// DoHPost sends queries in the body of POST requests.
+	DoHPost DoHMethod = iota
+
+	// DoHGet sends queries in the URL of GET requests, with a zero message ID,
+	// so that responses can be cached by HTTP caches.
+	DoHGet
+
+	// DoHAuto sends queries with GET requests, like DoHGet,
+	// unless the URL would exceed the maximum length set with [DoHMaxURLLength],
+	// in which case queries are sent with POST requests.
+	DoHAuto
+)
+
+// dohMaxURLLength is the default maximum URL length of GET requests.
+const dohMaxURLLength = 2048
+
+// DoHAllowInsecureScheme allows the plaintext "http" scheme,
+// which defeats the purpose of DNS over HTTPS.
+// This is meant for testing against a local server.
+func DoHAllowInsecureScheme() DoHOption { return dohInsecure{} }
+
+// DoHCleartextHTTP2 uses HTTP/2 over cleartext TCP (h2c) with the "http" scheme,
+// instead of HTTP/1.1. It requires [DoHAllowInsecureScheme].
+func DoHCleartextHTTP2() DoHOption { return dohH2C{} }
+
+// DoHOnUpstream sets a function that is called for every connection established to the resolver,
+// with the network address used. This reports failover between addresses.
+// Connections to a proxy are not reported.
+func DoHOnUpstream(f func(network, address string)) DoHOption { return dohOnUpstream(f) }
+
+// DoHOnResponse sets a function that is called for every HTTP response from the resolver,
+// for diagnostics, like inspecting Cache-Control, Age, or provider specific headers.
+// The response has no body, and changes to it are ignored.
+func DoHOnResponse(f func(*http.Response)) DoHOption { return dohResponse(f) }
+
+// DoHPersistentConnection pins a single, long-lived connection to the resolver,
+// multiplexing concurrent queries over HTTP/2, and never closing it for being idle.
+// This avoids handshake overhead for high query rates.
+// A dead connection is detected with HTTP/2 pings and replaced, failing over to the next address;
+// queries in flight on it are retried.
+// If the resolver doesn't support HTTP/2, queries are sent one at a time.
+func DoHPersistentConnection() DoHOption { return dohPersistent{} }
+
+// DoHMaxIdleConns sets the maximum number of idle connections to the resolver kept for reuse.
+// The default is [http.DefaultMaxIdleConnsPerHost].
+// It is ignored if a transport is set with [DoHTransport].
+func DoHMaxIdleConns(n int) DoHOption { return dohMaxIdle(n) }
+
+// DoHIdleConnTimeout sets how long an idle connection to the resolver is kept for reuse.
+// The default is 90 seconds.
+// It is ignored if a transport is set with [DoHTransport], or by [DoHPersistentConnection].
+func DoHIdleConnTimeout(d time.Duration) DoHOption { return dohIdleTime(d) }
+
+// DoHDialBackoff sets the delay between attempts to connect to the resolver's addresses,
+// which doubles on each attempt up to max, with jitter, and is bounded by the query deadline.
+// This avoids a tight retry loop against a flapping resolver.
+// The default is 10ms, up to 500ms; zero disables it.
+func DoHDialBackoff(backoff, max time.Duration) DoHOption { return dohBackoff{backoff, max} }
+
+// DoHConnMetrics collects connection metrics into m, using [httptrace.ClientTrace].
+// This reveals whether connections to the resolver are reused effectively.
+// By default, requests are not traced.
+func DoHConnMetrics(m *DoHMetrics) DoHOption { return dohMetrics{m} }
+
+// DoHMetrics are connection metrics of a DNS over HTTPS resolver, see [DoHConnMetrics].
+type DoHMetrics struct {
+	newConns   atomic.Uint64
+	reused     atomic.Uint64
+	handshakes atomic.Uint64
+	active     atomic.Int64
+}
+
+// NewConns returns the number of requests sent on newly opened connections.
+func (m *DoHMetrics) NewConns() uint64 { return m.newConns.Load() }
+
+// ReusedConns returns the number of requests sent on reused connections,
+// including HTTP/2 connections shared by concurrent requests.
+func (m *DoHMetrics) ReusedConns() uint64 { return m.reused.Load() }
+
+// Handshakes returns the number of successful TLS handshakes.
+func (m *DoHMetrics) Handshakes() uint64 { return m.handshakes.Load() }
+
+// ActiveRequests returns the number of requests in flight.
+func (m *DoHMetrics) ActiveRequests() int64 { return m.active.Load() }
+
+func (m *DoHMetrics) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				m.reused.Add(1)
+			} else {
+				m.newConns.Add(1)
+			}
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				m.handshakes.Add(1)
+			}
+		},
+	}
+}
+
+type dohClient struct {
+	http.Client
+	uri        string
+	onResponse func(*http.Response)
+	metrics    *DoHMetrics
+	trace      *httptrace.ClientTrace
+	method     DoHMethod
+	maxURL     int
+	tmpl       uriTemplate
+	vars       map[string]string
 
+	// backoff requested by the server
+	backoff struct {
+		sync.Mutex
+		until  time.Time
+		status *DoHStatusError
+	}
+}
+
+func (c *dohClient) roundTrip(ctx context.Context, msg string) (string, error) {
+	// honor backoff
+	if err := c.retryAfter(); err != nil {
+		return "", err
+	}
+
+	// trace request
+	if c.metrics != nil {
+		c.metrics.active.Add(1)
+		defer c.metrics.active.Add(-1)
+		ctx = httptrace.WithClientTrace(ctx, c.trace)
+	}
+
+	for i := 0; ; i++ {
 		// send request
-		res, err := client.Do(req)
+		res, err := c.do(ctx, msg)
 		if err != nil {
 			return "", err
 		}
 
-		defer res.Body.Close()
-		if res.StatusCode != http.StatusOK {
-			return "", errors.New(http.StatusText(res.StatusCode))
+		// a response in flight on a connection that's shutting down can fail;
+		// retry once on a new connection (failed requests are retried by do)
+		out, err := c.read(res, msg)
+		if err != nil && i == 0 && isGoAway(err) && ctx.Err() == nil {
+			continue
 		}
+		return out, err
+	}
+}
 
-		// read response
-		var str strings.Builder
-		_, err = io.Copy(&str, res.Body)
-		if err != nil {
+// isGoAway reports whether err was caused by an HTTP/2 GOAWAY frame,
+// sent by servers to gracefully shut down connections.
+func isGoAway(err error) bool {
+	var ga http2.GoAwayError
+	if errors.As(err, &ga) {
+		return true
+	}
+	// net/http bundles its own, unexported, HTTP/2 implementation
+	return strings.Contains(err.Error(), "GOAWAY")
+}
+
+// read reads the DNS message in the HTTP response res to msg.
+func (c *dohClient) read(res *http.Response, msg string) (string, error) {
+	defer res.Body.Close()
+	if c.onResponse != nil {
+		// headers only, so the body is unaffected
+		r := *res
+		r.Header = res.Header.Clone()
+		r.Body = http.NoBody
+		c.onResponse(&r)
+	}
+	if res.StatusCode != http.StatusOK {
+		status := &DoHStatusError{Code: res.StatusCode, Status: res.Status}
+		if err := c.setRetryAfter(res, status); err != nil {
 			return "", err
 		}
-		return str.String(), nil
+		return "", status
+	}
+	if typ, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); typ != "application/dns-message" {
+		return "", fmt.Errorf("dns: unexpected content type %q", res.Header.Get("Content-Type"))
 	}
-}
 
-func parseURITemplate(uri string) (string, error) {
+	// read response, up to the maximum message size
 	var str strings.Builder
-	var exp bool
+	_, err := io.Copy(&str, io.LimitReader(res.Body, math.MaxUint16+1))
+	if err != nil {
+		return "", err
+	}
+	if str.Len() > math.MaxUint16 {
+		return "", errors.New("dns: response too large")
+	}
 
-	for i := 0; i < len(uri); i++ {
-		switch c := uri[i]; c {
-		case '{':
-			if exp {
-				return "", errors.New("uri: invalid syntax")
+	// restore the message ID of GET requests
+	out := str.String()
+	if res.Request != nil && res.Request.Method == http.MethodGet && len(out) >= 2 {
+		out = msg[:2] + out[2:]
+	}
+
+	// responses from HTTP caches have aged (RFC 8484, section 5.1)
+	if age, max, ok := httpFreshness(res.Header); ok {
+		return ageTTLs(out, age, max), nil
+	}
+	return out, nil
+}
+
+// httpFreshness returns the Age and Cache-Control max-age of an HTTP response, in seconds.
+// If max-age is missing, max is the maximum TTL.
+func httpFreshness(h http.Header) (age, max uint32, ok bool) {
+	max = math.MaxUint32
+	if s, err := strconv.ParseUint(h.Get("Age"), 10, 31); err == nil {
+		age, ok = uint32(s), true
+	}
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if !strings.EqualFold(k, "max-age") {
+				continue
 			}
-			exp = true
-		case '}':
-			if !exp {
-				return "", errors.New("uri: invalid syntax")
+			if s, err := strconv.ParseUint(strings.Trim(v, `"`), 10, 31); err == nil {
+				max, ok = uint32(s), true
 			}
-			exp = false
+		}
+	}
+	return age, max, ok
+}
+
+// dohReadIdleTimeout is how long a persistent connection can be idle before it's health checked.
+const dohReadIdleTimeout = 30 * time.Second
+
+// dohDialBackoff and dohMaxDialBackoff bound the delay between dial attempts.
+const (
+	dohDialBackoff    = 10 * time.Millisecond
+	dohMaxDialBackoff = 500 * time.Millisecond
+)
+
+// dohRetries is the number of times a request is retried on connection errors.
+const dohRetries = 2
+
+func (c *dohClient) do(ctx context.Context, msg string) (res *http.Response, err error) {
+	get := c.getURL(msg)
+	for i := 0; i <= dohRetries; i++ {
+		// prepare request
+		var req *http.Request
+		if get != "" {
+			req, err = http.NewRequestWithContext(ctx, http.MethodGet, get, nil)
+		} else {
+			req, err = http.NewRequestWithContext(ctx,
+				http.MethodPost, c.uri, strings.NewReader(msg))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if get == "" {
+			req.Header.Set("Content-Type", "application/dns-message")
+		}
+		req.Header.Set("Accept", "application/dns-message")
+
+		// queries are idempotent, so retry on connection errors
+		res, err = c.Do(req)
+		if err == nil || ctx.Err() != nil || !connError(err) {
+			return res, err
+		}
+	}
+	return nil, err
+}
+
+// connError reports whether err is a connection failure, like a reset,
+// after which a request can be retried on a new connection.
+// Certificate, proxy, and malformed request errors are not retried.
+func connError(err error) bool {
+	// wrapped by tls.CertificateVerificationError since Go 1.20
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var record tls.RecordHeaderError
+	switch {
+	case errors.As(err, &unknown), errors.As(err, &hostname),
+		errors.As(err, &invalid), errors.As(err, &record):
+		return false
+	}
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		isGoAway(err)
+}
+
+// getURL returns the URL to send msg with a GET request,
+// or an empty string to send it with a POST request.
+// GET requests use a zero message ID, so HTTP caches can share them (RFC 8484, section 4.1).
+func (c *dohClient) getURL(msg string) string {
+	if c.method == DoHPost || len(msg) < 2 {
+		return ""
+	}
+	dns := base64.RawURLEncoding.EncodeToString([]byte("\x00\x00" + msg[2:]))
+
+	var get string
+	if c.tmpl != nil {
+		vars := make(map[string]string, len(c.vars)+1)
+		for k, v := range c.vars {
+			vars[k] = v
+		}
+		vars["dns"] = dns
+		get = c.tmpl.expand(vars)
+	} else if strings.Contains(c.uri, "?") {
+		get = c.uri + "&dns=" + dns
+	} else {
+		get = c.uri + "?dns=" + dns
+	}
+	if c.method == DoHAuto && len(get) > c.maxURL {
+		return ""
+	}
+	return get
+}
+
+func (c *dohClient) retryAfter() error {
+	c.backoff.Lock()
+	defer c.backoff.Unlock()
+	if d := time.Until(c.backoff.until); d > 0 {
+		return &RetryAfterError{DoHStatusError: c.backoff.status, RetryAfter: d}
+	}
+	return nil
+}
+
+func (c *dohClient) setRetryAfter(res *http.Response, status *DoHStatusError) error {
+	if res.StatusCode != http.StatusTooManyRequests &&
+		res.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+
+	// delay-seconds or HTTP-date
+	var d time.Duration
+	h := res.Header.Get("Retry-After")
+	if s, err := strconv.ParseUint(h, 10, 31); err == nil {
+		d = time.Duration(s) * time.Second
+	} else if t, err := http.ParseTime(h); err == nil {
+		d = time.Until(t)
+	}
+	if d <= 0 {
+		return nil
+	}
+
+	c.backoff.Lock()
+	defer c.backoff.Unlock()
+	c.backoff.until = time.Now().Add(d)
+	c.backoff.status = status
+	return &RetryAfterError{DoHStatusError: status, RetryAfter: d}
+}
+
+// A RetryAfterError is returned when a DoH server responds with
+// 429 Too Many Requests or 503 Service Unavailable, and a Retry-After header.
+// Queries fail with this error until the requested delay elapses.
+// It wraps the [DoHStatusError] of the response.
+type RetryAfterError struct {
+	*DoHStatusError
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%s: retry after %v", e.DoHStatusError.Error(), e.RetryAfter.Round(time.Second))
+}
+
+// Unwrap returns the [DoHStatusError] of the response.
+func (e *RetryAfterError) Unwrap() error { return e.DoHStatusError }
+
+// A DoHStatusError is returned when a DoH server responds with an HTTP status other than 200 OK,
+// wrapped in a [RetryAfterError] if it responds with a Retry-After header, see [RetryAfterError].
+// It implements [net.Error]: server errors (5xx) and 429 Too Many Requests are temporary.
+type DoHStatusError struct {
+	Code   int    // the status code, like 404
+	Status string // the status line, like "404 Not Found"
+}
+
+func (e *DoHStatusError) Error() string {
+	if e.Status == "" {
+		return fmt.Sprintf("dns: HTTP status %d", e.Code)
+	}
+	return "dns: HTTP status " + e.Status
+}
+
+// Timeout reports false; timeouts are reported by the http.Client.
+func (e *DoHStatusError) Timeout() bool { return false }
+
+// Temporary reports whether the request may succeed if retried.
+func (e *DoHStatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == http.StatusTooManyRequests
+}
+
+// A uriTemplate is a parsed URI Template (RFC 6570), up to level 3:
+// variables can't have modifiers, but expressions can have operators and multiple variables.
+type uriTemplate []uriPart
+
+type uriPart struct {
+	literal string
+	op      byte
+	vars    []string
+}
+
+func parseURITemplate(uri string) (uriTemplate, error) {
+	var tmpl uriTemplate
+	for {
+		i := strings.IndexAny(uri, "{}")
+		if i < 0 {
+			return append(tmpl, uriPart{literal: uri}), nil
+		}
+		if uri[i] == '}' {
+			return nil, errors.New("uri: invalid syntax")
+		}
+		j := strings.IndexAny(uri[i+1:], "{}")
+		if j < 0 || uri[i+1+j] == '{' {
+			return nil, errors.New("uri: invalid syntax")
+		}
+
+		part := uriPart{literal: uri[:i]}
+		expr := uri[i+1 : i+1+j]
+		if expr != "" && strings.IndexByte("+#./;?&", expr[0]) >= 0 {
+			part.op, expr = expr[0], expr[1:]
+		}
+		for _, v := range strings.Split(expr, ",") {
+			if !validVarName(v) {
+				return nil, fmt.Errorf("uri: unsupported template variable %q", v)
+			}
+			part.vars = append(part.vars, v)
+		}
+		tmpl = append(tmpl, part)
+		uri = uri[i+2+j:]
+	}
+}
+
+// validVarName reports whether name is a valid variable name, without modifiers.
+func validVarName(name string) bool {
+	if name == "" || name[0] == '.' || name[len(name)-1] == '.' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '_' || c == '.' || c == '%':
 		default:
-			if !exp {
-				str.WriteByte(c)
+			return false
+		}
+	}
+	return true
+}
+
+// has reports whether the template uses the variable name.
+func (t uriTemplate) has(name string) bool {
+	for _, p := range t {
+		for _, v := range p.vars {
+			if v == name {
+				return true
 			}
 		}
 	}
+	return false
+}
+
+// expand expands the template with vars; undefined variables are omitted.
+func (t uriTemplate) expand(vars map[string]string) string {
+	var buf strings.Builder
+	for _, p := range t {
+		buf.WriteString(p.literal)
+
+		first := true
+		for _, name := range p.vars {
+			value, ok := vars[name]
+			if !ok {
+				continue
+			}
+			switch {
+			case !first:
+				buf.WriteByte(uriSeparator(p.op))
+			case p.op != 0 && p.op != '+':
+				buf.WriteByte(p.op)
+			}
+			first = false
 
-	return str.String(), nil
+			switch p.op {
+			case ';':
+				buf.WriteString(name)
+				if value != "" {
+					buf.WriteByte('=')
+				}
+			case '?', '&':
+				buf.WriteString(name)
+				buf.WriteByte('=')
+			}
+			if p.op == '+' || p.op == '#' {
+				buf.WriteString(escapeURI(value, true))
+			} else {
+				buf.WriteString(escapeURI(value, false))
+			}
+		}
+	}
+	return buf.String()
+}
+
+// uriSeparator returns the separator of variables expanded with op.
+func uriSeparator(op byte) byte {
+	switch op {
+	case '.', '/', ';':
+		return op
+	case '?', '&':
+		return '&'
+	}
+	return ','
+}
+
+// escapeURI percent-encodes all but unreserved characters in s,
+// and reserved characters, if allowed.
+func escapeURI(s string, reserved bool) string {
+	const hex = "0123456789ABCDEF"
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~':
+			buf.WriteByte(c)
+		case reserved && strings.IndexByte(":/?#[]@!$&'()*+,;=", c) >= 0:
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(hex[c>>4])
+			buf.WriteByte(hex[c&15])
+		}
+	}
+	return buf.String()
 }
@@ -1,13 +1,30 @@
 package dns_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
+
 	"github.com/ncruces/go-dns"
 )
 
@@ -102,6 +119,111 @@ func TestNewDoHResolver(t *testing.T) {
 	})
 }
 
+func TestNewDoHResolverContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := dns.NewDoHResolverContext(ctx, "https://dns.google/dns-query")
+	if err == nil {
+		t.Errorf("NewDoHResolverContext(...) with canceled context succeeded")
+	}
+}
+
+func TestDoHLazyBootstrap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r, err := dns.NewDoHResolverContext(ctx, "https://dns.google/dns-query", dns.DoHLazyBootstrap())
+	if err != nil {
+		t.Fatalf("NewDoHResolverContext(...) error = %v", err)
+		return
+	}
+
+	_, err = r.LookupIPAddr(ctx, "one.one.one.one")
+	if err == nil {
+		t.Errorf("LookupIPAddr('one.one.one.one') with canceled context succeeded")
+	}
+}
+
+func TestDoHProxy(t *testing.T) {
+	var connect atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			connect.Store(r.Host)
+		}
+		http.Error(w, "proxy unavailable", http.StatusBadGateway)
+	}))
+	defer proxy.Close()
+
+	u, _ := url.Parse(proxy.URL)
+	r, err := dns.NewDoHResolver("https://dns.google/dns-query",
+		dns.DoHAddresses("127.0.0.1:1"),
+		dns.DoHProxy(http.ProxyURL(u)))
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	_, err = r.LookupIPAddr(context.TODO(), "one.one.one.one")
+	if err == nil {
+		t.Errorf("LookupIPAddr('one.one.one.one') through failing proxy succeeded")
+	}
+
+	if got := connect.Load(); got != "dns.google:443" {
+		t.Errorf("proxy got CONNECT %v", got)
+	}
+}
+
+func TestNewDoHResolver_scheme(t *testing.T) {
+	_, err := dns.NewDoHResolver("http://dns.google/dns-query",
+		dns.DoHAddresses("8.8.8.8"))
+	if err == nil {
+		t.Errorf("NewDoHResolver('http://...') succeeded")
+	}
+
+	_, err = dns.NewDoHResolver("http://dns.google/dns-query",
+		dns.DoHAddresses("8.8.8.8"),
+		dns.DoHAllowInsecureScheme())
+	if err != nil {
+		t.Errorf("NewDoHResolver('http://...') error = %v", err)
+	}
+}
+
+func TestDoHCleartextHTTP2(t *testing.T) {
+	var proto atomic.Value
+	handler := dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Proto)
+		handler.ServeHTTP(w, r)
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	r, err := dns.NewDoHResolver("http://"+addr+"/dns-query",
+		dns.DoHAddresses(addr),
+		dns.DoHAllowInsecureScheme(),
+		dns.DoHCleartextHTTP2())
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	ips, err := r.LookupIP(context.TODO(), "ip4", "example.com.")
+	if err != nil {
+		t.Fatalf("LookupIP('example.com.') error = %v", err)
+		return
+	}
+	if len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Errorf("LookupIP('example.com.') = %v", ips)
+	}
+
+	if got := proto.Load(); got != "HTTP/2.0" {
+		t.Errorf("got protocol %v", got)
+	}
+}
+
 func TestNewDoHResolver_64(t *testing.T) {
 	// Test IPv6 connectivity (broken on GitHub Actions).
 	if c, err := net.Dial("tcp", "ipv6.google.com:80"); err != nil {
@@ -147,3 +269,906 @@ func TestNewDoHResolver_64(t *testing.T) {
 		})
 	}
 }
+
+func TestRetryAfterError(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	r, err := dns.NewDoHResolver(srv.URL,
+		dns.DoHAddresses(addr),
+		dns.DoHAllowInsecureScheme())
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	for i := 0; i < 2; i++ {
+		var rae *dns.RetryAfterError
+		_, err = dns.Exchange(ctx, r, query)
+		if !errors.As(err, &rae) {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+		if rae.Code != http.StatusTooManyRequests || rae.RetryAfter <= 0 || rae.RetryAfter > time.Minute {
+			t.Errorf("Exchange(...) error = %#v", rae)
+		}
+		if !strings.HasPrefix(err.Error(), "dns: ") {
+			t.Errorf("Exchange(...) error = %v", err)
+		}
+	}
+
+	if n := requests.Load(); n != 1 {
+		t.Errorf("got %d requests, wanted 1", n)
+	}
+}
+
+func TestDoHStatusError(t *testing.T) {
+	tests := []struct {
+		code       int
+		retryAfter string
+		temporary  bool
+	}{
+		{http.StatusNotFound, "", false},
+		{http.StatusTooManyRequests, "", true},
+		{http.StatusBadGateway, "", true},
+		{http.StatusTooManyRequests, "60", true},
+		{http.StatusServiceUnavailable, "60", true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.code)+tt.retryAfter, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.code)
+			}))
+			defer srv.Close()
+
+			r, err := dns.NewDoHResolver(srv.URL,
+				dns.DoHAddresses(srv.Listener.Addr().String()),
+				dns.DoHAllowInsecureScheme())
+			if err != nil {
+				t.Fatalf("NewDoHResolver(...) error = %v", err)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err = dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA))
+			var se *dns.DoHStatusError
+			if !errors.As(err, &se) {
+				t.Fatalf("Exchange(...) error = %v", err)
+			}
+			if se.Code != tt.code || !strings.HasPrefix(se.Status, fmt.Sprint(tt.code)) {
+				t.Errorf("Exchange(...) error = %#v", se)
+			}
+			var ne net.Error
+			if !errors.As(err, &ne) || ne.Temporary() != tt.temporary || ne.Timeout() {
+				t.Errorf("Exchange(...) error = %v, temporary %v", err, ne.Temporary())
+			}
+		})
+	}
+}
+
+func TestDoHRetry(t *testing.T) {
+	var requests atomic.Int32
+	handler := dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// reset the connection on the first request
+		if requests.Add(1) == 1 {
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				conn.Close()
+			}
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	r, err := dns.NewDoHResolver(srv.URL,
+		dns.DoHAddresses(srv.Listener.Addr().String()),
+		dns.DoHAllowInsecureScheme())
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	if _, err := dns.Exchange(ctx, r, query); err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("got %d requests, wanted 2", n)
+	}
+}
+
+func TestDoHRetry_certificate(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	// the server's certificate isn't trusted
+	r, err := dns.NewDoHResolver(srv.URL, dns.DoHAddresses(srv.Listener.Addr().String()))
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	if _, err := dns.Exchange(ctx, r, query); err == nil {
+		t.Fatal("Exchange(...) succeeded")
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("got %d connections, wanted 1", n)
+	}
+}
+
+func TestDoHOnUpstream(t *testing.T) {
+	srv := httptest.NewServer(dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	}))
+	defer srv.Close()
+
+	var upstreams []string
+	addr := srv.Listener.Addr().String()
+	r, err := dns.NewDoHResolver(srv.URL,
+		dns.DoHAddresses("127.0.0.1:1", addr),
+		dns.DoHAllowInsecureScheme(),
+		dns.DoHOnUpstream(func(network, address string) {
+			upstreams = append(upstreams, network+" "+address)
+		}))
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// fails over, and retries
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	if _, err := dns.Exchange(ctx, r, query); err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+
+	want := []string{"tcp " + addr}
+	if !check(upstreams, want) {
+		t.Errorf("OnUpstream got %v, wanted %v", upstreams, want)
+	}
+}
+
+func TestDoHContentType(t *testing.T) {
+	var accept atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept.Store(r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", "application/dns-json")
+		w.Write([]byte(`{"Status": 0}`))
+	}))
+	defer srv.Close()
+
+	r, err := dns.NewDoHResolver(srv.URL,
+		dns.DoHAddresses(srv.Listener.Addr().String()),
+		dns.DoHAllowInsecureScheme())
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	_, err = dns.Exchange(ctx, r, query)
+	if err == nil || !strings.Contains(err.Error(), "application/dns-json") {
+		t.Errorf("Exchange(...) error = %v", err)
+	}
+	if got := accept.Load(); got != "application/dns-message" {
+		t.Errorf("got Accept %q", got)
+	}
+}
+
+func TestDoHLargeResponse(t *testing.T) {
+	// many strings, larger than typical read buffers
+	var txt []string
+	for i := 0; i < 200; i++ {
+		txt = append(txt, strings.Repeat(string(rune('a'+i%26)), 200))
+	}
+
+	srv := httptest.NewServer(dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+		res := answer(req, 60)
+		res.RCode = dnsmessage.RCodeSuccess
+		for i := 0; i < len(txt); i += 50 {
+			res.Answers = append(res.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{
+					Name:  req.Questions[0].Name,
+					Type:  dnsmessage.TypeTXT,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				},
+				Body: &dnsmessage.TXTResource{TXT: txt[i : i+50]},
+			})
+		}
+		return res
+	}))
+	defer srv.Close()
+
+	r, err := dns.NewDoHResolver(srv.URL,
+		dns.DoHAddresses(srv.Listener.Addr().String()),
+		dns.DoHAllowInsecureScheme())
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	got, err := r.LookupTXT(context.TODO(), "example.com.")
+	if err != nil {
+		t.Fatalf("LookupTXT('example.com.') error = %v", err)
+	}
+	if n := len(strings.Join(got, "")); n != 200*200 {
+		t.Errorf("LookupTXT('example.com.') returned %d bytes, wanted %d", n, 200*200)
+	}
+}
+
+func TestDoHPersistentConnection(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	r, err := dns.NewDoHResolver(srv.URL,
+		dns.DoHAddresses(srv.Listener.Addr().String()),
+		dns.DoHTransport(&http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}),
+		dns.DoHPersistentConnection())
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			query := newQuery(t, uint16(i), "example.com.", dnsmessage.TypeA)
+			if _, err := dns.Exchange(ctx, r, query); err != nil {
+				t.Errorf("Exchange(...) error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := conns.Load(); n != 1 {
+		t.Errorf("got %d connections, wanted 1", n)
+	}
+}
+
+func TestDoHOnResponse(t *testing.T) {
+	handler := dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Diagnostic", "cached")
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	var diagnostic atomic.Value
+	r, err := dns.NewDoHResolver(srv.URL,
+		dns.DoHAddresses(srv.Listener.Addr().String()),
+		dns.DoHAllowInsecureScheme(),
+		dns.DoHOnResponse(func(res *http.Response) {
+			diagnostic.Store(res.Header.Get("X-Diagnostic"))
+			io.ReadAll(res.Body) // doesn't consume the response
+			res.Header.Set("Content-Type", "text/plain")
+		}))
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	if _, err := dns.Exchange(ctx, r, query); err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+	if got := diagnostic.Load(); got != "cached" {
+		t.Errorf("got X-Diagnostic %q", got)
+	}
+}
+
+func TestDoHResolver_age(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   uint32
+	}{
+		{"None", http.Header{}, 60},
+		{"Age", http.Header{"Age": {"50"}}, 10},
+		{"Expired", http.Header{"Age": {"90"}}, 0},
+		{"MaxAge", http.Header{"Cache-Control": {"public, max-age=30"}}, 30},
+		{"Both", http.Header{"Age": {"20"}, "Cache-Control": {"max-age=30"}}, 10},
+		{"Invalid", http.Header{"Age": {"-5"}}, 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+				return answer(req, 60, "192.0.2.1")
+			})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header()[k] = v
+				}
+				handler.ServeHTTP(w, r)
+			}))
+			defer srv.Close()
+
+			var cache dns.Cache
+			r, err := dns.NewDoHResolver(srv.URL,
+				dns.DoHAddresses(srv.Listener.Addr().String()),
+				dns.DoHAllowInsecureScheme(),
+				dns.DoHCache(dns.CacheHandle(&cache)))
+			if err != nil {
+				t.Fatalf("NewDoHResolver(...) error = %v", err)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			res, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA))
+			if err != nil {
+				t.Fatalf("Exchange(...) error = %v", err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(res); err != nil || len(msg.Answers) != 1 {
+				t.Fatalf("Unpack(...) = %v, %v", msg, err)
+			}
+			if got := msg.Answers[0].Header.TTL; got != tt.want {
+				t.Errorf("got TTL %d, wanted %d", got, tt.want)
+			}
+
+			remaining := time.Duration(tt.want) * time.Second
+			for _, e := range cache.Entries() {
+				if e.RemainingTTL > remaining {
+					t.Errorf("Entries() = %+v, wanted at most %v", e, remaining)
+				}
+			}
+		})
+	}
+}
+
+func TestNewDoHResolver_local(t *testing.T) {
+	zone := newTestZone()
+	zone.addHost("one.one.one.one.", "1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001")
+	zone.setRCode("servfail.test.", dnsmessage.RCodeServerFailure)
+	srv := dohServer(t, zone.handler)
+
+	r, err := dns.NewDoHResolver(srv.URL,
+		dns.DoHAddresses(srv.Listener.Addr().String()),
+		dns.DoHTransport(srv.Client().Transport.(*http.Transport)))
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, name := range []string{"nxdomain.test", "servfail.test"} {
+		if e, err := r.LookupIPAddr(ctx, name); err == nil {
+			t.Errorf("LookupIPAddr(%q) = %v", name, e)
+		}
+	}
+
+	ips, err := r.LookupIPAddr(ctx, "one.one.one.one")
+	if err != nil {
+		t.Fatalf("LookupIPAddr('one.one.one.one') error = %v", err)
+		return
+	}
+	if !checkIPAddrs(ips, "1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001") {
+		t.Errorf("LookupIPAddr('one.one.one.one') = %v", ips)
+	}
+}
+
+func TestDoHConnMetrics(t *testing.T) {
+	srv := dohServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	var metrics dns.DoHMetrics
+	r, err := dns.NewDoHResolver(srv.URL,
+		dns.DoHAddresses(srv.Listener.Addr().String()),
+		dns.DoHTransport(srv.Client().Transport.(*http.Transport)),
+		dns.DoHConnMetrics(&metrics))
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 3; i++ {
+		if _, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA)); err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+	}
+
+	if n := metrics.NewConns(); n != 1 {
+		t.Errorf("NewConns() = %d, wanted 1", n)
+	}
+	if n := metrics.ReusedConns(); n != 2 {
+		t.Errorf("ReusedConns() = %d, wanted 2", n)
+	}
+	if n := metrics.Handshakes(); n != 1 {
+		t.Errorf("Handshakes() = %d, wanted 1", n)
+	}
+	if n := metrics.ActiveRequests(); n != 0 {
+		t.Errorf("ActiveRequests() = %d, wanted 0", n)
+	}
+}
+
+func TestDoHIdleConns(t *testing.T) {
+	handler := dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond) // overlap concurrent queries
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// sends n concurrent queries, and returns the number of new connections
+	newConns := func(t *testing.T, options ...dns.DoHOption) func(n int) uint64 {
+		var metrics dns.DoHMetrics
+		options = append(options,
+			dns.DoHAddresses(srv.Listener.Addr().String()),
+			dns.DoHAllowInsecureScheme(),
+			dns.DoHConnMetrics(&metrics))
+		r, err := dns.NewDoHResolver(srv.URL, options...)
+		if err != nil {
+			t.Fatalf("NewDoHResolver(...) error = %v", err)
+		}
+		return func(n int) uint64 {
+			before := metrics.NewConns()
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA)); err != nil {
+						t.Errorf("Exchange(...) error = %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+			return metrics.NewConns() - before
+		}
+	}
+
+	t.Run("MaxIdleConns", func(t *testing.T) {
+		query := newConns(t)
+		query(4)
+		if n := query(4); n != 2 {
+			t.Errorf("got %d new connections, wanted 2", n)
+		}
+
+		query = newConns(t, dns.DoHMaxIdleConns(4))
+		query(4)
+		if n := query(4); n != 0 {
+			t.Errorf("got %d new connections, wanted 0", n)
+		}
+	})
+
+	t.Run("IdleConnTimeout", func(t *testing.T) {
+		query := newConns(t, dns.DoHIdleConnTimeout(10*time.Millisecond))
+		query(1)
+		time.Sleep(100 * time.Millisecond)
+		if n := query(1); n != 1 {
+			t.Errorf("got %d new connections, wanted 1", n)
+		}
+	})
+}
+
+func TestDoHDialBackoff(t *testing.T) {
+	// connections are refused
+	addrs := []string{"127.0.0.1:1", "[::1]:1"}
+
+	lookup := func(backoff time.Duration, timeout time.Duration) time.Duration {
+		r, err := dns.NewDoHResolver("https://dns.example/dns-query",
+			dns.DoHAddresses(addrs...),
+			dns.DoHDialBackoff(backoff, backoff))
+		if err != nil {
+			t.Fatalf("NewDoHResolver(...) error = %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		start := time.Now()
+		if ips, err := r.LookupIPAddr(ctx, "example.com"); err == nil {
+			t.Errorf("LookupIPAddr(...) = %v", ips)
+		}
+		return time.Since(start)
+	}
+
+	if d := lookup(100*time.Millisecond, 5*time.Second); d < 50*time.Millisecond {
+		t.Errorf("failed after %v, wanted backoff", d)
+	}
+	if d := lookup(time.Hour, 200*time.Millisecond); d > 2*time.Second {
+		t.Errorf("failed after %v, wanted the deadline", d)
+	}
+}
+
+func TestDoHNoBootstrap(t *testing.T) {
+	if _, err := dns.NewDoHResolver("https://dns.example/dns-query", dns.DoHNoBootstrap()); err == nil {
+		t.Error("NewDoHResolver(...) without addresses succeeded")
+	}
+	if _, err := dns.NewDoHResolver("https://dns.example/dns-query", dns.DoHNoBootstrap(), dns.DoHAddresses("192.0.2.1")); err != nil {
+		t.Errorf("NewDoHResolver(...) with addresses error = %v", err)
+	}
+
+	srv := dohServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	r, err := dns.NewDoHResolver(srv.URL,
+		dns.DoHNoBootstrap(),
+		dns.DoHTransport(srv.Client().Transport.(*http.Transport)))
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) with IP address error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if ips, err := r.LookupIPAddr(ctx, "example.com"); err != nil || !checkIPAddrs(ips, "192.0.2.1") {
+		t.Errorf("LookupIPAddr(...) = %v, %v", ips, err)
+	}
+}
+
+func TestDoHRequestMethod(t *testing.T) {
+	var method atomic.Value
+	var id atomic.Int32
+	handler := dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+		id.Store(int32(req.ID))
+		return answer(req, 60, "192.0.2.1")
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method.Store(r.Method)
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	uri := srv.URL + "/dns-query"
+	query := newQuery(t, 1234, "example.com.", dnsmessage.TypeA)
+	limit := len(uri) + len("?dns=") + base64.RawURLEncoding.EncodedLen(len(query))
+
+	tests := []struct {
+		name    string
+		options []dns.DoHOption
+		want    string
+	}{
+		{"Default", nil, http.MethodPost},
+		{"GET", []dns.DoHOption{dns.DoHRequestMethod(dns.DoHGet), dns.DoHMaxURLLength(1)}, http.MethodGet},
+		{"AutoFits", []dns.DoHOption{dns.DoHRequestMethod(dns.DoHAuto), dns.DoHMaxURLLength(limit)}, http.MethodGet},
+		{"AutoExceeds", []dns.DoHOption{dns.DoHRequestMethod(dns.DoHAuto), dns.DoHMaxURLLength(limit - 1)}, http.MethodPost},
+		{"AutoDefault", []dns.DoHOption{dns.DoHRequestMethod(dns.DoHAuto)}, http.MethodGet},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := dns.NewDoHResolver(uri, append(tt.options, dns.DoHAllowInsecureScheme())...)
+			if err != nil {
+				t.Fatalf("NewDoHResolver(...) error = %v", err)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			res, err := dns.Exchange(ctx, r, query)
+			if err != nil {
+				t.Fatalf("Exchange(...) error = %v", err)
+			}
+			if got := method.Load(); got != tt.want {
+				t.Errorf("got method %v, wanted %v", got, tt.want)
+			}
+
+			// GET requests have a zero ID, which is restored
+			wantID := int32(1234)
+			if tt.want == http.MethodGet {
+				wantID = 0
+			}
+			if got := id.Load(); got != wantID {
+				t.Errorf("server got ID %d, wanted %d", got, wantID)
+			}
+			if got := binary.BigEndian.Uint16(res); got != 1234 {
+				t.Errorf("got ID %d, wanted 1234", got)
+			}
+		})
+	}
+}
+
+func TestDoHURITemplate(t *testing.T) {
+	var uri atomic.Value
+	handler := dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri.Store(r.URL.RequestURI())
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	query := newQuery(t, 1234, "example.com.", dnsmessage.TypeA)
+	param := base64.RawURLEncoding.EncodeToString(append([]byte{0, 0}, query[2:]...))
+	get := dns.DoHRequestMethod(dns.DoHGet)
+	vars := dns.DoHTemplateVars(map[string]string{"ct": "application/dns-message", "tenant": "a b"})
+
+	tests := []struct {
+		name    string
+		tmpl    string
+		options []dns.DoHOption
+		want    string
+	}{
+		{"POST", "/dns-query{?dns}", nil, "/dns-query"},
+		{"POSTVars", "/{tenant}/dns-query{?dns,ct}", []dns.DoHOption{vars}, "/a%20b/dns-query?ct=application%2Fdns-message"},
+		{"GET", "/dns-query{?dns}", []dns.DoHOption{get}, "/dns-query?dns=" + param},
+		{"GETVars", "/dns-query{?dns,ct}", []dns.DoHOption{get, vars}, "/dns-query?dns=" + param + "&ct=application%2Fdns-message"},
+		{"GETUndefined", "/dns-query{?ct,dns}", []dns.DoHOption{get}, "/dns-query?dns=" + param},
+		{"GETContinuation", "/dns-query?x=1{&dns}", []dns.DoHOption{get}, "/dns-query?x=1&dns=" + param},
+		{"GETPath", "{/tenant}/dns-query{?dns}", []dns.DoHOption{get, vars}, "/a%20b/dns-query?dns=" + param},
+		{"GETNoVariable", "/dns-query", []dns.DoHOption{get}, "/dns-query?dns=" + param},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := dns.NewDoHResolver(srv.URL+tt.tmpl, append(tt.options, dns.DoHAllowInsecureScheme())...)
+			if err != nil {
+				t.Fatalf("NewDoHResolver(...) error = %v", err)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			if _, err := dns.Exchange(ctx, r, query); err != nil {
+				t.Fatalf("Exchange(...) error = %v", err)
+			}
+			if got := uri.Load(); got != tt.want {
+				t.Errorf("got URI %v, wanted %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, tmpl := range []string{"{?dns", "?dns}", "{{dns}}", "{?dns:3}", "{?dns*}", "{}", "{=dns}"} {
+		if _, err := dns.NewDoHResolver(srv.URL+tmpl, dns.DoHAllowInsecureScheme()); err == nil {
+			t.Errorf("NewDoHResolver(%q) succeeded", tmpl)
+		}
+	}
+}
+
+func TestDoHGoAway(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int32
+		wantErr  bool
+	}{
+		{"Once", 1, false},
+		{"Twice", 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			addr := goAwayServer(t, func() bool {
+				return requests.Add(1) <= tt.failures
+			})
+
+			r, err := dns.NewDoHResolver("http://"+addr+"/dns-query",
+				dns.DoHAddresses(addr),
+				dns.DoHAllowInsecureScheme(),
+				dns.DoHCleartextHTTP2())
+			if err != nil {
+				t.Fatalf("NewDoHResolver(...) error = %v", err)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err = dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Exchange(...) error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if n := requests.Load(); n != 2 {
+				t.Errorf("got %d requests, wanted 2", n)
+			}
+		})
+	}
+}
+
+// goAwayServer starts an HTTP/2 cleartext server that answers DoH POST queries.
+// If goAway returns true, the connection is shut down with GOAWAY
+// while the response is in flight.
+func goAwayServer(t testing.TB, goAway func() bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		preface := make([]byte, len(http2.ClientPreface))
+		if _, err := io.ReadFull(conn, preface); err != nil {
+			return
+		}
+		fr := http2.NewFramer(conn, conn)
+		if err := fr.WriteSettings(); err != nil {
+			return
+		}
+
+		var body []byte
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			switch f := f.(type) {
+			case *http2.SettingsFrame:
+				if !f.IsAck() {
+					fr.WriteSettingsAck()
+				}
+			case *http2.DataFrame:
+				body = append(body, f.Data()...)
+				if !f.StreamEnded() {
+					continue
+				}
+				var req dnsmessage.Message
+				if err := req.Unpack(body); err != nil {
+					return
+				}
+				ans := answer(req, 60, "192.0.2.1")
+				res, err := ans.Pack()
+				if err != nil {
+					return
+				}
+
+				var hdr bytes.Buffer
+				enc := hpack.NewEncoder(&hdr)
+				enc.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+				enc.WriteField(hpack.HeaderField{Name: "content-type", Value: "application/dns-message"})
+				fr.WriteHeaders(http2.HeadersFrameParam{
+					StreamID:      f.StreamID,
+					BlockFragment: hdr.Bytes(),
+					EndHeaders:    true,
+				})
+				if goAway() {
+					fr.WriteData(f.StreamID, false, res[:4])
+					fr.WriteGoAway(f.StreamID, http2.ErrCodeNo, nil)
+					return
+				}
+				fr.WriteData(f.StreamID, true, res)
+				body = nil
+			}
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func BenchmarkExchangeBatch_doh(b *testing.B) {
+	srv := dohServer(b, func(req dnsmessage.Message) dnsmessage.Message {
+		time.Sleep(5 * time.Millisecond)
+		if req.Questions[0].Type == dnsmessage.TypeAAAA {
+			return answer(req, 60, "2001:db8::1")
+		}
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	r, err := dns.NewDoHResolver(srv.URL,
+		dns.DoHAddresses(srv.Listener.Addr().String()),
+		dns.DoHTransport(srv.Client().Transport.(*http.Transport)))
+	if err != nil {
+		b.Fatalf("NewDoHResolver(...) error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	queries := [][]byte{
+		newQuery(b, 1, "example.com.", dnsmessage.TypeA),
+		newQuery(b, 2, "example.com.", dnsmessage.TypeAAAA),
+	}
+
+	// batched queries are sent as concurrent HTTP/2 streams
+	b.Run("Batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := dns.ExchangeBatch(ctx, r, queries); err != nil {
+				b.Fatalf("ExchangeBatch(...) error = %v", err)
+			}
+		}
+	})
+	b.Run("Serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, query := range queries {
+				if _, err := dns.Exchange(ctx, r, query); err != nil {
+					b.Fatalf("Exchange(...) error = %v", err)
+				}
+			}
+		}
+	})
+}
+
+func TestDoHNoDeadline(t *testing.T) {
+	srv := httptest.NewServer(dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	}))
+	defer srv.Close()
+
+	r, err := dns.NewDoHResolver(srv.URL+"/dns-query", dns.DoHAllowInsecureScheme())
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+	}
+
+	// no deadline is set on the connection
+	if _, err := dns.Exchange(context.TODO(), r, newQuery(t, 1, "example.com.", dnsmessage.TypeA)); err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+
+	ips, err := r.LookupIPAddr(context.TODO(), "example.com")
+	if err != nil {
+		t.Fatalf("LookupIPAddr('example.com') error = %v", err)
+	}
+	if !checkIPAddrs(ips, "192.0.2.1") {
+		t.Errorf("LookupIPAddr('example.com') = %v", ips)
+	}
+}
@@ -3,13 +3,42 @@ package dns
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
+	"io"
 	"net"
-	"sync/atomic"
+	"net/netip"
+	"time"
+
+	"golang.org/x/net/proxy"
 )
 
 // NewDoTResolver creates a DNS over TLS resolver.
 // The server can be an IP address, a host name, or a network address of the form "host:port".
+//
+// The server is also used to verify the server's certificate.
+// If it is an IP address, no SNI is sent, and the certificate must be valid for the IP;
+// use [DoTServerName] to verify against a host name instead.
 func NewDoTResolver(server string, options ...DoTOption) (*net.Resolver, error) {
+	return NewDoTResolverContext(context.Background(), server, options...)
+}
+
+// NewDoTResolverContext is like [NewDoTResolver],
+// but uses ctx to resolve the server's network addresses.
+func NewDoTResolverContext(ctx context.Context, server string, options ...DoTOption) (*net.Resolver, error) {
+	r, err := newDoTResolver(ctx, server, options...)
+	if err != nil {
+		return nil, err
+	}
+	return r.Resolver, nil
+}
+
+// NewDoTResolverWithClose is like [NewDoTResolver],
+// but returns a [Resolver] that can be closed.
+func NewDoTResolverWithClose(server string, options ...DoTOption) (*Resolver, error) {
+	return newDoTResolver(context.Background(), server, options...)
+}
+
+func newDoTResolver(ctx context.Context, server string, options ...DoTOption) (*Resolver, error) {
 	// look for a custom port
 	host, port, err := net.SplitHostPort(server)
 	if err != nil {
@@ -25,38 +54,75 @@ func NewDoTResolver(server string, options ...DoTOption) (*net.Resolver, error)
 	}
 
 	// resolve server network addresses
-	if len(opts.addrs) == 0 {
-		ips, err := OpportunisticResolver.LookupIPAddr(context.Background(), server)
-		if err != nil {
-			return nil, err
+	var addrs addrList
+	if addrs.addrs, err = normalizeAddrs(opts.addrs, port); err != nil {
+		return nil, err
+	}
+	addrs.rand = randFunc(opts.rand)
+	addrs.setWeights(opts.weights)
+	addrs.latency = opts.latency
+	if len(addrs.addrs) == 0 && opts.noLookup {
+		// only IP addresses don't need resolving
+		if _, err := netip.ParseAddr(server); err != nil {
+			return nil, errNoAddresses
 		}
-		opts.addrs = make([]string, len(ips))
-		for i, ip := range ips {
-			opts.addrs[i] = net.JoinHostPort(ip.String(), port)
+		addrs.addrs = []string{net.JoinHostPort(server, port)}
+	}
+	if len(addrs.addrs) == 0 {
+		lookup := func(ctx context.Context) ([]string, error) {
+			return lookupAddrs(ctx, server, port)
 		}
-	} else {
-		for i, a := range opts.addrs {
-			if net.ParseIP(a) != nil {
-				opts.addrs[i] = net.JoinHostPort(a, port)
-			}
+		if opts.lazy {
+			addrs.lookup = lookup
+		} else if addrs.addrs, err = lookup(ctx); err != nil {
+			return nil, err
 		}
 	}
 
 	// setup TLS config
 	if opts.config == nil {
 		opts.config = &tls.Config{
-			ClientSessionCache: tls.NewLRUClientSessionCache(len(opts.addrs)),
+			MinVersion:         tls.VersionTLS12,
+			ClientSessionCache: tls.NewLRUClientSessionCache(len(addrs.addrs)),
 		}
 	} else {
 		opts.config = opts.config.Clone()
 	}
-	if opts.config.ServerName == "" {
+	switch opts.minVersion {
+	case 0:
+	case tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13:
+		opts.config.MinVersion = opts.minVersion
+	default:
+		return nil, fmt.Errorf("dns: invalid TLS version %#04x", opts.minVersion)
+	}
+	if opts.ciphers != nil {
+		for _, id := range opts.ciphers {
+			if err := checkCipherSuite(id); err != nil {
+				return nil, err
+			}
+		}
+		opts.config.CipherSuites = opts.ciphers
+	}
+	for _, size := range []*int{opts.readBuf, opts.writeBuf} {
+		if size != nil && *size <= 0 {
+			return nil, fmt.Errorf("dns: invalid buffer size %d", *size)
+		}
+	}
+	if opts.keyLog != nil {
+		opts.config.KeyLogWriter = opts.keyLog
+	}
+	if opts.serverName != "" {
+		opts.config.ServerName = opts.serverName
+	} else if opts.config.ServerName == "" {
 		opts.config.ServerName = server
 	}
 
 	// setup the dialFunc
 	if opts.dialFunc == nil {
-		var d net.Dialer
+		d := net.Dialer{KeepAlive: opts.keepAlive}
+		if opts.fastOpen {
+			d.Control = fastOpenControl
+		}
 		opts.dialFunc = d.DialContext
 	}
 
@@ -64,23 +130,67 @@ func NewDoTResolver(server string, options ...DoTOption) (*net.Resolver, error)
 	var resolver = net.Resolver{PreferGo: true}
 
 	// setup dialer
-	var index atomic.Uint32
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := opts.dialFunc(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			if opts.keepAlive > 0 {
+				tcp.SetKeepAlive(true)
+				tcp.SetKeepAlivePeriod(opts.keepAlive)
+			} else if opts.keepAlive < 0 {
+				tcp.SetKeepAlive(false)
+			}
+			if opts.noDelay != nil {
+				tcp.SetNoDelay(*opts.noDelay)
+			}
+			if opts.readBuf != nil {
+				tcp.SetReadBuffer(*opts.readBuf)
+			}
+			if opts.writeBuf != nil {
+				tcp.SetWriteBuffer(*opts.writeBuf)
+			}
+		}
+		tlsConn := tls.Client(conn, opts.config)
+		if opts.handshake > 0 {
+			// a stalled handshake fails over to the next address
+			ctx, cancel := context.WithTimeout(ctx, opts.handshake)
+			defer cancel()
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return tlsConn, nil
+	}
 	resolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
-		i := index.Load()
-		conn, err := opts.dialFunc(ctx, "tcp", opts.addrs[i])
+		conn, addr, err := addrs.dial(ctx, dial, "tcp")
 		if err != nil {
-			index.CompareAndSwap(i, (i+1)%uint32(len(opts.addrs)))
 			return nil, err
 		}
-		return tls.Client(conn, opts.config), nil
+		if opts.onUpstream != nil {
+			opts.onUpstream("tcp", addr)
+		}
+		return addrs.measure(conn, addr), nil
 	}
 
 	// setup caching
 	if opts.cache {
-		resolver.Dial = NewCachingDialer(resolver.Dial, opts.cacheOpts...)
+		resolver.Dial = NewCachingDialer(resolver.Dial, withMaxQueue(opts.cacheOpts, opts.maxQueue)...)
+		resolver.StrictErrors = strictErrors(opts.cacheOpts, false)
 	}
 
-	return &resolver, nil
+	res := newResolver(&resolver, &addrs, nil)
+	res.conf = ResolverConfig{
+		DoT:        net.JoinHostPort(server, port),
+		Addresses:  append([]string(nil), addrs.addrs...),
+		ServerName: opts.config.ServerName,
+	}
+	if opts.cache {
+		res.conf.Cache = cacheConfig(opts.cacheOpts)
+	}
+	return res, nil
 }
 
 // A DoTOption customizes the DNS over TLS resolver.
@@ -89,36 +199,212 @@ type DoTOption interface {
 }
 
 type dotOpts struct {
-	config    *tls.Config
-	addrs     []string
-	cache     bool
-	cacheOpts []CacheOption
-	dialFunc  DialFunc
+	config     *tls.Config
+	addrs      []string
+	weights    []int
+	cache      bool
+	cacheOpts  []CacheOption
+	dialFunc   DialFunc
+	keepAlive  time.Duration
+	noDelay    *bool
+	lazy       bool
+	serverName string
+	onUpstream func(network, address string)
+	handshake  time.Duration
+	minVersion uint16
+	ciphers    []uint16
+	noLookup   bool
+	latency    bool
+	keyLog     io.Writer
+	readBuf    *int
+	writeBuf   *int
+	fastOpen   bool
+	rand       RandSource
+	maxQueue   int
 }
 
 type (
-	dotConfig    tls.Config
-	dotAddresses []string
-	dotCache     []CacheOption
-	dotDialFunc  DialFunc
+	dotConfig     tls.Config
+	dotAddresses  []string
+	dotWeighted   map[string]int
+	dotCache      []CacheOption
+	dotDialFunc   DialFunc
+	dotKeepAlive  time.Duration
+	dotNoDelay    bool
+	dotLazy       struct{}
+	dotServerName string
+	dotOnUpstream func(network, address string)
+	dotHandshake  time.Duration
+	dotMinVersion uint16
+	dotCiphers    []uint16
+	dotNoBoot     struct{}
+	dotLatency    struct{}
+	dotKeyLog     struct{ io.Writer }
+	dotReadBuf    int
+	dotWriteBuf   int
+	dotFastOpen   struct{}
+	dotRand       RandSource
+	dotMaxQueue   int
 )
 
-func (o *dotConfig) apply(t *dotOpts)   { t.config = (*tls.Config)(o) }
-func (o dotAddresses) apply(t *dotOpts) { t.addrs = ([]string)(o) }
-func (o dotCache) apply(t *dotOpts)     { t.cache = true; t.cacheOpts = ([]CacheOption)(o) }
-func (o dotDialFunc) apply(t *dotOpts)  { t.dialFunc = (DialFunc)(o) }
+func (o *dotConfig) apply(t *dotOpts)    { t.config = (*tls.Config)(o) }
+func (o dotAddresses) apply(t *dotOpts)  { t.addrs = ([]string)(o); t.weights = nil }
+func (o dotWeighted) apply(t *dotOpts)   { t.addrs, t.weights = weightedAddrs(o) }
+func (o dotCache) apply(t *dotOpts)      { t.cache = true; t.cacheOpts = ([]CacheOption)(o) }
+func (o dotDialFunc) apply(t *dotOpts)   { t.dialFunc = (DialFunc)(o) }
+func (o dotKeepAlive) apply(t *dotOpts)  { t.keepAlive = time.Duration(o) }
+func (o dotNoDelay) apply(t *dotOpts)    { t.noDelay = (*bool)(&o) }
+func (o dotLazy) apply(t *dotOpts)       { t.lazy = true }
+func (o dotServerName) apply(t *dotOpts) { t.serverName = string(o) }
+func (o dotOnUpstream) apply(t *dotOpts) { t.onUpstream = o }
+func (o dotHandshake) apply(t *dotOpts)  { t.handshake = time.Duration(o) }
+func (o dotMinVersion) apply(t *dotOpts) { t.minVersion = uint16(o) }
+func (o dotCiphers) apply(t *dotOpts)    { t.ciphers = ([]uint16)(o) }
+func (o dotNoBoot) apply(t *dotOpts)     { t.noLookup = true }
+func (o dotLatency) apply(t *dotOpts)    { t.latency = true }
+func (o dotKeyLog) apply(t *dotOpts)     { t.keyLog = o.Writer }
+func (o dotReadBuf) apply(t *dotOpts)    { t.readBuf = (*int)(&o) }
+func (o dotWriteBuf) apply(t *dotOpts)   { t.writeBuf = (*int)(&o) }
+func (o dotFastOpen) apply(t *dotOpts)   { t.fastOpen = true }
+func (o dotRand) apply(t *dotOpts)       { t.rand = RandSource(o) }
+func (o dotMaxQueue) apply(t *dotOpts)   { t.maxQueue = int(o) }
 
 // DoTConfig sets the tls.Config used by the resolver.
+// By default, TLS 1.2 is required, and sessions are resumed using a client session cache.
+// TLS 1.3 early data (0-RTT) is not supported by crypto/tls, so queries are never sent as early data.
 func DoTConfig(config *tls.Config) DoTOption { return (*dotConfig)(config) }
 
 // DoTAddresses sets the network addresses of the resolver.
-// These should be IP addresses, or network addresses of the form "IP:port".
+// These must be IP addresses, or network addresses of the form "IP:port".
 // This avoids having to resolve the resolver's addresses, improving performance and privacy.
 func DoTAddresses(addresses ...string) DoTOption { return dotAddresses(addresses) }
 
+// DoTWeightedAddresses is like [DoTAddresses], but selects an address at random for each connection,
+// in proportion to its weight, instead of failing over in order.
+// Addresses that fail are avoided until all of them have failed.
+func DoTWeightedAddresses(addresses map[string]int) DoTOption { return dotWeighted(addresses) }
+
 // DoTCache adds caching to the resolver, with the given options.
 func DoTCache(options ...CacheOption) DoTOption { return dotCache(options) }
 
 // DoTDialFunc sets the DialFunc used by the resolver.
 // By default [net.Dialer.DialContext] is used.
 func DoTDialFunc(f DialFunc) DoTOption { return dotDialFunc(f) }
+
+// DoTProxy sets a [proxy.Dialer], like a SOCKS5 proxy, used to connect to the resolver.
+// It is an alternative to [DoTDialFunc]; the TLS server name is unaffected.
+func DoTProxy(d proxy.Dialer) DoTOption {
+	if d, ok := d.(proxy.ContextDialer); ok {
+		return dotDialFunc(d.DialContext)
+	}
+	return dotDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return d.Dial(network, address)
+	})
+}
+
+// DoTKeepAlive sets the keep-alive period for connections to the resolver,
+// as in [net.Dialer.KeepAlive]: negative disables keep-alives.
+// It also applies to [net.TCPConn] connections returned by a DialFunc.
+func DoTKeepAlive(d time.Duration) DoTOption { return dotKeepAlive(d) }
+
+// DoTNoDelay sets whether to disable Nagle's algorithm on connections to the resolver,
+// as in [net.TCPConn.SetNoDelay].
+func DoTNoDelay(b bool) DoTOption { return dotNoDelay(b) }
+
+// DoTFastOpen enables TCP Fast Open (RFC 7413) for connections to the resolver,
+// so that the TLS ClientHello is sent with the SYN, saving a round-trip
+// when reconnecting to a server that issued a Fast Open cookie.
+// It is ignored if a DialFunc is set.
+//
+// It requires Linux 4.11 or later, with client support enabled
+// (bit 0x1 of net.ipv4.tcp_fastopen, the default);
+// elsewhere, or if the kernel doesn't support it, connections are established normally.
+func DoTFastOpen() DoTOption { return dotFastOpen{} }
+
+// DoTReadBuffer sets the size of the operating system's receive buffer
+// for connections to the resolver, as in [net.TCPConn.SetReadBuffer].
+// The size must be positive. It is a hint: the operating system may
+// round it, double it (Linux), or cap it (net.core.rmem_max on Linux).
+// It is ignored if the DialFunc doesn't return a [*net.TCPConn].
+func DoTReadBuffer(size int) DoTOption { return dotReadBuf(size) }
+
+// DoTWriteBuffer sets the size of the operating system's send buffer
+// for connections to the resolver, as in [net.TCPConn.SetWriteBuffer].
+// The size must be positive; platform limits are as for [DoTReadBuffer]
+// (net.core.wmem_max on Linux).
+func DoTWriteBuffer(size int) DoTOption { return dotWriteBuf(size) }
+
+// DoTRand sets the source of randomness used to select among [DoTWeightedAddresses], see [RandSource].
+func DoTRand(f RandSource) DoTOption { return dotRand(f) }
+
+// DoTMaxQueue sets the maximum size, in bytes, of the queries queued on a connection to the resolver,
+// before they're sent; writes over it fail.
+// By default, the queue fits a full [ExchangeBatch] of maximum size queries.
+// It only applies with [DoTCache]; otherwise, queries are sent over TLS as they're written.
+func DoTMaxQueue(size int) DoTOption { return dotMaxQueue(size) }
+
+// DoTLatencyAware selects the fastest address for each connection, instead of failing over in order.
+// Latency is a moving average of the round-trip time of queries to each address,
+// and is reported by [Resolver.Upstreams].
+// Addresses that fail are avoided until all of them have failed.
+func DoTLatencyAware() DoTOption { return dotLatency{} }
+
+// DoTLazyBootstrap defers resolving the server's network addresses until the first query.
+// Addresses are resolved again if all of them fail.
+// This allows creating the resolver before the network is up.
+func DoTLazyBootstrap() DoTOption { return dotLazy{} }
+
+// DoTNoBootstrap never resolves the server's network addresses,
+// so that queries can't leak to the resolver used for bootstrapping.
+// Addresses must then be set with [DoTAddresses], unless the server is an IP address;
+// otherwise, creating the resolver fails.
+func DoTNoBootstrap() DoTOption { return dotNoBoot{} }
+
+// DoTServerName sets the name used for SNI and to verify the server's certificate,
+// independently of the address used to connect to the resolver.
+// It overrides the [tls.Config.ServerName] set with [DoTConfig].
+func DoTServerName(name string) DoTOption { return dotServerName(name) }
+
+// DoTOnUpstream sets a function that is called for every connection established to the resolver,
+// with the network address used. This reports failover between addresses.
+func DoTOnUpstream(f func(network, address string)) DoTOption { return dotOnUpstream(f) }
+
+// DoTHandshakeTimeout sets a timeout for the TLS handshake with the resolver.
+// The handshake is then completed while connecting, and a stalled handshake fails over to the next address.
+// By default, the handshake happens on the first query, bounded only by its deadline.
+func DoTHandshakeTimeout(d time.Duration) DoTOption { return dotHandshake(d) }
+
+// DoTMinVersion sets the minimum TLS version accepted, like [tls.VersionTLS13].
+// It overrides the [tls.Config.MinVersion] set with [DoTConfig].
+func DoTMinVersion(version uint16) DoTOption { return dotMinVersion(version) }
+
+// DoTCipherSuites restricts the cipher suites accepted to those given,
+// which must be among [tls.CipherSuites].
+// It overrides the [tls.Config.CipherSuites] set with [DoTConfig].
+// TLS 1.3 cipher suites are not configurable, and are rejected, so this only affects TLS 1.2 and below;
+// use [DoTMinVersion] to require TLS 1.3 instead.
+func DoTCipherSuites(suites ...uint16) DoTOption { return dotCiphers(suites) }
+
+// DoTKeyLog writes TLS session keys to w, in NSS key log format,
+// so that captured traffic can be decrypted by tools like Wireshark.
+// It overrides the [tls.Config.KeyLogWriter] set with [DoTConfig].
+//
+// This compromises the security of every connection to the resolver,
+// and should only be used for debugging.
+func DoTKeyLog(w io.Writer) DoTOption { return dotKeyLog{w} }
+
+// checkCipherSuite checks that id is a secure cipher suite, configurable for TLS 1.2 and below.
+func checkCipherSuite(id uint16) error {
+	for _, s := range tls.CipherSuites() {
+		if s.ID != id {
+			continue
+		}
+		for _, v := range s.SupportedVersions {
+			if v < tls.VersionTLS13 {
+				return nil
+			}
+		}
+		return fmt.Errorf("dns: TLS 1.3 cipher suite %#04x is not configurable", id)
+	}
+	return fmt.Errorf("dns: invalid TLS cipher suite %#04x", id)
+}
@@ -0,0 +1,89 @@
+//go:build linux
+
+package dns_test
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ncruces/go-dns"
+)
+
+func TestDoTSocketOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		name      string
+		options   []dns.DoTOption
+		keepAlive int
+		keepIdle  int
+		noDelay   int
+	}{
+		{"KeepAlive", []dns.DoTOption{dns.DoTKeepAlive(42 * time.Second)}, 1, 42, 1},
+		{"NoKeepAlive", []dns.DoTOption{dns.DoTKeepAlive(-1)}, 0, -1, 1},
+		{"NoDelay", []dns.DoTOption{dns.DoTNoDelay(false)}, 1, 15, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tcp *net.TCPConn
+			options := append(tt.options, dns.DoTDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+				// keep-alives start enabled, every 15 seconds
+				var d net.Dialer
+				conn, err := d.DialContext(ctx, network, ln.Addr().String())
+				if err == nil {
+					tcp = conn.(*net.TCPConn)
+				}
+				return conn, err
+			}))
+			r, err := dns.NewDoTResolver("127.0.0.1", options...)
+			if err != nil {
+				t.Fatalf("NewDoTResolver(...) error = %v", err)
+			}
+
+			conn, err := r.Dial(context.Background(), "tcp", "")
+			if err != nil {
+				t.Fatalf("Dial(...) error = %v", err)
+			}
+			defer conn.Close()
+
+			raw, err := tcp.SyscallConn()
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw.Control(func(fd uintptr) {
+				getsockopt := func(level, opt int) int {
+					v, err := syscall.GetsockoptInt(int(fd), level, opt)
+					if err != nil {
+						t.Fatal(err)
+					}
+					return v
+				}
+				if v := getsockopt(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != tt.keepAlive {
+					t.Errorf("SO_KEEPALIVE = %d, wanted %d", v, tt.keepAlive)
+				}
+				if v := getsockopt(syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); tt.keepIdle >= 0 && v != tt.keepIdle {
+					t.Errorf("TCP_KEEPIDLE = %d, wanted %d", v, tt.keepIdle)
+				}
+				if v := getsockopt(syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != tt.noDelay {
+					t.Errorf("TCP_NODELAY = %d, wanted %d", v, tt.noDelay)
+				}
+			})
+		})
+	}
+}
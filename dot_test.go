@@ -2,13 +2,21 @@ package dns_test
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"golang.org/x/net/dns/dnsmessage"
+
 	"github.com/ncruces/go-dns"
 )
 
@@ -139,6 +147,261 @@ func TestNewDoTResolver(t *testing.T) {
 	})
 }
 
+func TestNewDoTResolverContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := dns.NewDoTResolverContext(ctx, "dns.google")
+	if err == nil {
+		t.Errorf("NewDoTResolverContext(...) with canceled context succeeded")
+	}
+}
+
+func TestDoTLazyBootstrap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r, err := dns.NewDoTResolverContext(ctx, "dns.google", dns.DoTLazyBootstrap())
+	if err != nil {
+		t.Fatalf("NewDoTResolverContext(...) error = %v", err)
+		return
+	}
+
+	_, err = r.LookupIPAddr(ctx, "one.one.one.one")
+	if err == nil {
+		t.Errorf("LookupIPAddr('one.one.one.one') with canceled context succeeded")
+	}
+}
+
+func TestDoTProxy(t *testing.T) {
+	var proxy proxyDialer
+	r, err := dns.NewDoTResolver("dns.google",
+		dns.DoTAddresses("192.0.2.1:853"),
+		dns.DoTProxy(&proxy))
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+		return
+	}
+
+	_, err = r.LookupIPAddr(context.TODO(), "one.one.one.one")
+	if err == nil {
+		t.Errorf("LookupIPAddr('one.one.one.one') through failing proxy succeeded")
+	}
+
+	if got := proxy.addr.Load(); got != "192.0.2.1:853" {
+		t.Errorf("proxy dialed %v", got)
+	}
+}
+
+type proxyDialer struct{ addr atomic.Value }
+
+func (d *proxyDialer) Dial(network, addr string) (net.Conn, error) {
+	d.addr.Store(addr)
+	return nil, errors.New("proxy unavailable")
+}
+
+func TestDoTServerName(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []dns.DoTOption
+		want    string
+	}{
+		{"IP", nil, ""},
+		{"ServerName", []dns.DoTOption{dns.DoTServerName("cloudflare-dns.com")}, "cloudflare-dns.com"},
+		{"Config", []dns.DoTOption{dns.DoTConfig(&tls.Config{ServerName: "one.one.one.one"})}, "one.one.one.one"},
+		{"Override", []dns.DoTOption{
+			dns.DoTConfig(&tls.Config{ServerName: "one.one.one.one"}),
+			dns.DoTServerName("cloudflare-dns.com")}, "cloudflare-dns.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// record the SNI sent by the client, then fail the handshake
+			sni := make(chan string, 1)
+			config := &tls.Config{
+				GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+					sni <- hello.ServerName
+					return nil, errors.New("handshake rejected")
+				},
+			}
+			dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+				client, server := net.Pipe()
+				go func() {
+					defer server.Close()
+					tls.Server(server, config).Handshake()
+				}()
+				return client, nil
+			}
+
+			options := append(tt.options, dns.DoTDialFunc(dial))
+			r, err := dns.NewDoTResolver("1.1.1.1", options...)
+			if err != nil {
+				t.Fatalf("NewDoTResolver(...) error = %v", err)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+			if _, err := dns.Exchange(ctx, r, query); err == nil {
+				t.Fatal("Exchange(...) with rejected handshake succeeded")
+			}
+			if got := <-sni; got != tt.want {
+				t.Errorf("ServerName = %q, wanted %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoTAddresses(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{addr: "1.1.1.1", want: "1.1.1.1:853"},
+		{addr: "1.1.1.1:8853", want: "1.1.1.1:8853"},
+		{addr: "2606:4700:4700::1111", want: "[2606:4700:4700::1111]:853"},
+		{addr: "[2606:4700:4700::1111]", want: "[2606:4700:4700::1111]:853"},
+		{addr: "[2606:4700:4700::1111]:8853", want: "[2606:4700:4700::1111]:8853"},
+		{addr: "fe80::1%eth0", want: "[fe80::1%eth0]:853"},
+		{addr: "[fe80::1%2]", want: "[fe80::1%2]:853"},
+		{addr: "[fe80::1%en0]:8853", want: "[fe80::1%en0]:8853"},
+		{addr: "", wantErr: true},
+		{addr: "one.one.one.one", wantErr: true},
+		{addr: "1.1.1.1:", wantErr: true},
+		{addr: "1.1.1.1:abc", wantErr: true},
+		{addr: "1.1.1.1:70000", wantErr: true},
+		{addr: "[2606:4700:4700::1111]:-1", wantErr: true},
+		{addr: "[1.1.1.1", wantErr: true},
+		{addr: "2606:4700:4700::1111]:853", wantErr: true},
+		{addr: "fe80::1%", wantErr: true},
+		{addr: "[fe80::1%eth 0]:853", wantErr: true},
+		{addr: "[fe80::1%eth0/1]:853", wantErr: true},
+		{addr: "1.1.1.1%eth0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			var proxy proxyDialer
+			r, err := dns.NewDoTResolver("one.one.one.one",
+				dns.DoTAddresses(tt.addr),
+				dns.DoTProxy(&proxy))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewDoTResolver(...) error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			r.LookupIPAddr(context.TODO(), "one.one.one.one")
+			if got := proxy.addr.Load(); got != tt.want {
+				t.Errorf("proxy dialed %v, wanted %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDoTOnUpstream(t *testing.T) {
+	var upstreams []string
+	r, err := dns.NewDoTResolver("dns.example",
+		dns.DoTAddresses("192.0.2.1", "192.0.2.2"),
+		dns.DoTDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			if address == "192.0.2.1:853" {
+				return nil, errors.New("unreachable")
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}),
+		dns.DoTOnUpstream(func(network, address string) {
+			upstreams = append(upstreams, network+" "+address)
+		}))
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	dns.Exchange(ctx, r, query) // fails over
+
+	want := []string{"tcp 192.0.2.2:853"}
+	if !check(upstreams, want) {
+		t.Errorf("OnUpstream got %v, wanted %v", upstreams, want)
+	}
+}
+
+func TestDoTWeightedAddresses(t *testing.T) {
+	var down atomic.Bool
+	dialed := map[string]int{}
+	r, err := dns.NewDoTResolver("dns.example",
+		dns.DoTWeightedAddresses(map[string]int{"192.0.2.1": 1, "192.0.2.2": 3, "192.0.2.3": 0}),
+		dns.DoTDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed[address]++
+			if down.Load() && address == "192.0.2.2:853" {
+				return nil, errors.New("unreachable")
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}))
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+		return
+	}
+
+	for i := 0; i < 1000; i++ {
+		r.Dial(context.TODO(), "tcp", "")
+	}
+	if n := dialed["192.0.2.1:853"]; n < 150 || n > 350 {
+		t.Errorf("dialed 192.0.2.1 %d times, wanted about 250", n)
+	}
+	if n := dialed["192.0.2.3:853"]; n != 0 {
+		t.Errorf("dialed 192.0.2.3 %d times, wanted 0", n)
+	}
+
+	// after failing once, 192.0.2.2 is avoided
+	down.Store(true)
+	dialed = map[string]int{}
+	for i := 0; i < 1000; i++ {
+		r.Dial(context.TODO(), "tcp", "")
+	}
+	if n := dialed["192.0.2.2:853"]; n > 1 {
+		t.Errorf("dialed 192.0.2.2 %d times, wanted at most 1", n)
+	}
+}
+
+func TestDialError(t *testing.T) {
+	errUnreachable := errors.New("unreachable")
+	r, err := dns.NewDoTResolver("dns.example",
+		dns.DoTAddresses("192.0.2.1", "2001:db8::1"),
+		dns.DoTDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, errUnreachable
+		}))
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+		return
+	}
+
+	_, err = r.Dial(context.TODO(), "tcp", "")
+	var derr *dns.DialError
+	if !errors.As(err, &derr) {
+		t.Fatalf("Dial(...) error = %v", err)
+	}
+	want := []dns.AddrError{
+		{Addr: "192.0.2.1:853", Err: errUnreachable},
+		{Addr: "[2001:db8::1]:853", Err: errUnreachable},
+	}
+	if !check(derr.Errors, want) {
+		t.Errorf("Dial(...) errors = %v, wanted %v", derr.Errors, want)
+	}
+	if !errors.Is(err, errUnreachable) {
+		t.Errorf("Dial(...) error = %v, wanted %v", err, errUnreachable)
+	}
+}
+
 func TestNewDoTResolver_64(t *testing.T) {
 	// Test IPv6 connectivity (broken on GitHub Actions).
 	if c, err := net.Dial("tcp", "ipv6.google.com:80"); err != nil {
@@ -189,3 +452,425 @@ func TestNewDoTResolver_64(t *testing.T) {
 		})
 	}
 }
+
+func TestDoTHandshakeTimeout(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+	config := &tls.Config{Certificates: srv.TLS.Certificates}
+
+	var upstreams []string
+	r, err := dns.NewDoTResolver("dns.example",
+		dns.DoTAddresses("192.0.2.1", "192.0.2.2"),
+		dns.DoTConfig(&tls.Config{InsecureSkipVerify: true}),
+		dns.DoTHandshakeTimeout(100*time.Millisecond),
+		dns.DoTDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				if address == "192.0.2.1:853" {
+					// stall the handshake
+					io.Copy(io.Discard, server)
+					return
+				}
+				conn := tls.Server(server, config)
+				if conn.Handshake() == nil {
+					io.Copy(io.Discard, conn)
+				}
+			}()
+			return client, nil
+		}),
+		dns.DoTOnUpstream(func(network, address string) {
+			upstreams = append(upstreams, network+" "+address)
+		}))
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := r.Dial(ctx, "tcp", "")
+	if err != nil {
+		t.Fatalf("Dial(...) error = %v", err)
+	}
+	conn.Close()
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Dial(...) took %v", d)
+	}
+	want := []string{"tcp 192.0.2.2:853"}
+	if !check(upstreams, want) {
+		t.Errorf("OnUpstream got %v, wanted %v", upstreams, want)
+	}
+}
+
+func TestDoTMinVersion(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+	config := &tls.Config{
+		Certificates: srv.TLS.Certificates,
+		MaxVersion:   tls.VersionTLS12,
+	}
+
+	tests := []struct {
+		name    string
+		version uint16
+		wantErr bool
+	}{
+		{"Default", 0, false},
+		{"TLS12", tls.VersionTLS12, false},
+		{"TLS13", tls.VersionTLS13, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := []dns.DoTOption{
+				dns.DoTAddresses("192.0.2.1"),
+				dns.DoTConfig(&tls.Config{InsecureSkipVerify: true}),
+				dns.DoTHandshakeTimeout(time.Second),
+				dns.DoTDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+					client, server := net.Pipe()
+					go func() {
+						defer server.Close()
+						conn := tls.Server(server, config)
+						if conn.Handshake() == nil {
+							io.Copy(io.Discard, conn)
+						}
+					}()
+					return client, nil
+				}),
+			}
+			if tt.version != 0 {
+				options = append(options, dns.DoTMinVersion(tt.version))
+			}
+			r, err := dns.NewDoTResolver("dns.example", options...)
+			if err != nil {
+				t.Fatalf("NewDoTResolver(...) error = %v", err)
+				return
+			}
+
+			conn, err := r.Dial(context.TODO(), "tcp", "")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Dial(...) error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				conn.Close()
+			}
+		})
+	}
+
+	if _, err := dns.NewDoTResolver("dns.example",
+		dns.DoTAddresses("192.0.2.1"),
+		dns.DoTMinVersion(0x1234)); err == nil {
+		t.Error("NewDoTResolver(...) with invalid version succeeded")
+	}
+}
+
+func TestNewDoTResolver_local(t *testing.T) {
+	zone := newTestZone()
+	zone.addHost("one.one.one.one.", "1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001")
+	zone.setRCode("servfail.test.", dnsmessage.RCodeServerFailure)
+	addr, config := dotServer(t, zone.handler)
+
+	r, err := dns.NewDoTResolver("example.com",
+		dns.DoTAddresses(addr),
+		dns.DoTConfig(config))
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, name := range []string{"nxdomain.test", "servfail.test"} {
+		if e, err := r.LookupIPAddr(ctx, name); err == nil {
+			t.Errorf("LookupIPAddr(%q) = %v", name, e)
+		}
+	}
+
+	ips, err := r.LookupIPAddr(ctx, "one.one.one.one")
+	if err != nil {
+		t.Fatalf("LookupIPAddr('one.one.one.one') error = %v", err)
+		return
+	}
+	if !checkIPAddrs(ips, "1.1.1.1", "1.0.0.1", "2606:4700:4700::1111", "2606:4700:4700::1001") {
+		t.Errorf("LookupIPAddr('one.one.one.one') = %v", ips)
+	}
+
+	// the certificate is verified
+	r, err = dns.NewDoTResolver("dns.example", dns.DoTAddresses(addr))
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+		return
+	}
+	if ips, err := r.LookupIPAddr(ctx, "one.one.one.one"); err == nil {
+		t.Errorf("LookupIPAddr('one.one.one.one') with untrusted certificate = %v", ips)
+	}
+}
+
+func TestDoTCipherSuites(t *testing.T) {
+	addr, config := dotServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	var negotiated atomic.Uint32
+	config.MaxVersion = tls.VersionTLS12
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		negotiated.Store(uint32(cs.CipherSuite))
+		return nil
+	}
+
+	for _, suite := range []uint16{
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	} {
+		r, err := dns.NewDoTResolver("example.com",
+			dns.DoTAddresses(addr),
+			dns.DoTConfig(config),
+			dns.DoTCipherSuites(suite),
+			dns.DoTHandshakeTimeout(time.Second))
+		if err != nil {
+			t.Fatalf("NewDoTResolver(...) error = %v", err)
+			return
+		}
+
+		conn, err := r.Dial(context.TODO(), "tcp", "")
+		if err != nil {
+			t.Fatalf("Dial(...) error = %v", err)
+		}
+		if got := uint16(negotiated.Load()); got != suite {
+			t.Errorf("got cipher suite %s, wanted %s", tls.CipherSuiteName(got), tls.CipherSuiteName(suite))
+		}
+		conn.Close()
+	}
+
+	if _, err := dns.NewDoTResolver("dns.example",
+		dns.DoTAddresses("192.0.2.1"),
+		dns.DoTCipherSuites(tls.TLS_RSA_WITH_RC4_128_SHA)); err == nil {
+		t.Error("NewDoTResolver(...) with insecure cipher suite succeeded")
+	}
+	if _, err := dns.NewDoTResolver("dns.example",
+		dns.DoTAddresses("192.0.2.1"),
+		dns.DoTCipherSuites(tls.TLS_AES_128_GCM_SHA256)); err == nil {
+		t.Error("NewDoTResolver(...) with TLS 1.3 cipher suite succeeded")
+	}
+}
+
+func TestDoTNoBootstrap(t *testing.T) {
+	if _, err := dns.NewDoTResolver("dns.example", dns.DoTNoBootstrap()); err == nil {
+		t.Error("NewDoTResolver(...) without addresses succeeded")
+	}
+	if _, err := dns.NewDoTResolver("dns.example", dns.DoTNoBootstrap(), dns.DoTLazyBootstrap()); err == nil {
+		t.Error("NewDoTResolver(...) with lazy bootstrap succeeded")
+	}
+	if _, err := dns.NewDoTResolver("dns.example", dns.DoTNoBootstrap(), dns.DoTAddresses("192.0.2.1")); err != nil {
+		t.Errorf("NewDoTResolver(...) with addresses error = %v", err)
+	}
+	if _, err := dns.NewDoTResolver("192.0.2.1:8853", dns.DoTNoBootstrap()); err != nil {
+		t.Errorf("NewDoTResolver(...) with IP address error = %v", err)
+	}
+}
+
+func TestDoTLatencyAware(t *testing.T) {
+	var slowQueries atomic.Int32
+	slow, config := dotServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		slowQueries.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return answer(req, 60, "192.0.2.1")
+	})
+	fast, _ := dotServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	r, err := dns.NewDoTResolverWithClose("example.com",
+		dns.DoTAddresses(slow, fast),
+		dns.DoTConfig(config),
+		dns.DoTLatencyAware())
+	if err != nil {
+		t.Fatalf("NewDoTResolverWithClose(...) error = %v", err)
+		return
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 10; i++ {
+		if _, err := dns.Exchange(ctx, r.Resolver, newQuery(t, uint16(i), "example.com.", dnsmessage.TypeA)); err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+	}
+	if n := slowQueries.Load(); n != 1 {
+		t.Errorf("got %d queries to the slow address, wanted 1", n)
+	}
+
+	stats := r.Upstreams()
+	if len(stats) != 2 || stats[0].Addr != slow || stats[1].Addr != fast {
+		t.Fatalf("Upstreams() = %v", stats)
+	}
+	if stats[0].Latency < 50*time.Millisecond || stats[1].Latency <= 0 || stats[1].Latency >= stats[0].Latency {
+		t.Errorf("Upstreams() = %v", stats)
+	}
+}
+
+func TestDoTKeyLog(t *testing.T) {
+	addr, config := dotServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	var keys strings.Builder
+	r, err := dns.NewDoTResolver("example.com",
+		dns.DoTAddresses(addr),
+		dns.DoTConfig(config),
+		dns.DoTKeyLog(&keys))
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA)); err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+	if !strings.Contains(keys.String(), "CLIENT_") {
+		t.Errorf("got key log %q", keys.String())
+	}
+	if config.KeyLogWriter != nil {
+		t.Error("DoTKeyLog(...) modified the config")
+	}
+}
+
+func TestDoTBuffers(t *testing.T) {
+	addr, config := dotServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	r, err := dns.NewDoTResolver("example.com",
+		dns.DoTAddresses(addr),
+		dns.DoTConfig(config),
+		dns.DoTReadBuffer(64<<10),
+		dns.DoTWriteBuffer(64<<10))
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA)); err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+
+	for _, opt := range []dns.DoTOption{dns.DoTReadBuffer(0), dns.DoTWriteBuffer(-1)} {
+		if _, err := dns.NewDoTResolver("example.com", dns.DoTAddresses(addr), opt); err == nil {
+			t.Error("NewDoTResolver(...) succeeded with an invalid buffer size")
+		}
+	}
+}
+
+func TestDoTFastOpen(t *testing.T) {
+	addr, config := dotServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	r, err := dns.NewDoTResolver("example.com",
+		dns.DoTAddresses(addr),
+		dns.DoTConfig(config),
+		dns.DoTFastOpen())
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the second connection may use a Fast Open cookie
+	for i := 0; i < 2; i++ {
+		if _, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA)); err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+	}
+}
+
+func TestDoTRand(t *testing.T) {
+	dialed := map[string]int{}
+	r, err := dns.NewDoTResolver("dns.example",
+		dns.DoTWeightedAddresses(map[string]int{"192.0.2.1": 1, "192.0.2.2": 3}),
+		dns.DoTRand(func() uint64 { return 3 }),
+		dns.DoTDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed[address]++
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}))
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+		return
+	}
+
+	// the last unit of weight always selects 192.0.2.2
+	for i := 0; i < 100; i++ {
+		r.Dial(context.TODO(), "tcp", "")
+	}
+	if n := dialed["192.0.2.2:853"]; n != 100 {
+		t.Errorf("dialed 192.0.2.2 %d times, wanted 100", n)
+	}
+}
+
+func TestDoTLazyBootstrap_reresolve(t *testing.T) {
+	var down atomic.Bool
+	down.Store(true)
+	r, err := dns.NewDoTResolverWithClose("localhost",
+		dns.DoTLazyBootstrap(),
+		dns.DoTLatencyAware(),
+		dns.DoTDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			if down.Load() {
+				return nil, errors.New("unreachable")
+			}
+			client, server := net.Pipe()
+			server.Close()
+			return client, nil
+		}))
+	if err != nil {
+		t.Fatalf("NewDoTResolverWithClose(...) error = %v", err)
+		return
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// concurrent first dials share the lookup
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, err := r.Dial(ctx, "tcp", ""); err == nil {
+				conn.Close()
+				t.Error("Dial(...) succeeded")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// after every address failed, they're resolved again
+	down.Store(false)
+	conn, err := r.Dial(ctx, "tcp", "")
+	if err != nil {
+		t.Fatalf("Dial(...) error = %v", err)
+	}
+	conn.Close()
+	for _, up := range r.Upstreams() {
+		if up.Down {
+			t.Errorf("Upstreams() = %v, wanted none down", r.Upstreams())
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package dns
+
+// Messages are rewritten and inspected by walking their wire format.
+// Features must not break resolution on malformed messages:
+// rewriting returns unparseable messages unchanged,
+// and inspecting them reports nothing, so the feature is skipped.
+
+// DefaultEDNSBufSize is the EDNS UDP payload size recommended by DNS Flag Day 2020.
+const DefaultEDNSBufSize = 1232
+
+// findOPT finds the EDNS OPT record of msg.
+// It returns the offset of the record's type field (or -1 if there is none),
+// and the end offset of the last record.
+// For unparseable messages, ok is false.
+func findOPT(msg string) (opt, end int, ok bool) {
+	if len(msg) < 12 { // header size
+		return -1, 0, false
+	}
+
+	qdcount := getUint16(msg[4:])
+	ancount := getUint16(msg[6:])
+	nscount := getUint16(msg[8:])
+	arcount := getUint16(msg[10:])
+	rdcount := ancount + nscount + arcount
+
+	i := 12 // skip header
+	opt = -1
+
+	// skip questions
+	for n := 0; n < qdcount; n++ {
+		name := getNameLen(msg[i:])
+		if name < 0 || i+name+4 > len(msg) {
+			return -1, 0, false
+		}
+		i += name + 4
+	}
+
+	// look for an OPT record
+	for n := 0; n < rdcount; n++ {
+		name := getNameLen(msg[i:])
+		if name < 0 || i+name+10 > len(msg) {
+			return -1, 0, false
+		}
+		rtyp := getUint16(msg[i+name:])
+		rlen := getUint16(msg[i+name+8:])
+		if n >= ancount+nscount && rtyp == 41 && opt < 0 {
+			opt = i + name
+		}
+		i += name + 10 + rlen
+		if i > len(msg) {
+			return -1, 0, false
+		}
+	}
+	return opt, i, true
+}
+
+// addOPT returns msg with an empty EDNS OPT record advertising size,
+// and the offset of the record's type field.
+func addOPT(msg string, end int, size uint16) (string, int) {
+	arcount := getUint16(msg[10:]) + 1
+	msg = msg[:10] + string([]byte{byte(arcount >> 8), byte(arcount)}) + msg[12:end] +
+		string([]byte{0, 0, 41, byte(size >> 8), byte(size), 0, 0, 0, 0, 0, 0})
+	return msg, end + 1
+}
+
+// setEDNSBufSize returns req with an EDNS OPT record advertising size.
+// An existing OPT record is updated; otherwise one is added.
+// Unparseable messages are returned unchanged.
+func setEDNSBufSize(req string, size uint16) string {
+	opt, end, ok := findOPT(req)
+	if !ok {
+		return req
+	}
+	if opt < 0 {
+		if getUint16(req[10:]) >= 0xffff {
+			return req
+		}
+		req, _ = addOPT(req, end, size)
+		return req
+	}
+	// the CLASS field holds the payload size
+	return req[:opt+2] + string([]byte{byte(size >> 8), byte(size)}) + req[opt+4:]
+}
+
+// addEDNSOption returns req with the EDNS option code set to data,
+// adding an OPT record if needed.
+// Unparseable messages are returned unchanged.
+func addEDNSOption(req string, code uint16, data string) string {
+	opt, end, ok := findOPT(req)
+	if !ok {
+		return req
+	}
+	if opt < 0 {
+		if getUint16(req[10:]) >= 0xffff {
+			return req
+		}
+		req, opt = addOPT(req, end, DefaultEDNSBufSize)
+	}
+
+	rdata := opt + 10 + getUint16(req[opt+8:])
+	rlen := rdata - opt - 10 + 4 + len(data)
+	if rlen > 0xffff || !validOptions(req[opt+10:rdata]) {
+		return req
+	}
+	return req[:opt+8] + string([]byte{byte(rlen >> 8), byte(rlen)}) + req[opt+10:rdata] +
+		string([]byte{byte(code >> 8), byte(code), byte(len(data) >> 8), byte(len(data))}) + data +
+		req[rdata:]
+}
+
+// validOptions reports whether rdata holds a sequence of whole EDNS options.
+func validOptions(rdata string) bool {
+	for len(rdata) >= 4 {
+		olen := getUint16(rdata[2:])
+		if 4+olen > len(rdata) {
+			return false
+		}
+		rdata = rdata[4+olen:]
+	}
+	return len(rdata) == 0
+}
+
+// getEDNSOption returns the data of the EDNS option code of res.
+// For unparseable messages, ok is false.
+func getEDNSOption(res string, code uint16) (data string, ok bool) {
+	opt, _, ok := findOPT(res)
+	if !ok || opt < 0 {
+		return "", false
+	}
+
+	rdata := res[opt+10 : opt+10+getUint16(res[opt+8:])]
+	for len(rdata) >= 4 {
+		ocode := getUint16(rdata)
+		olen := getUint16(rdata[2:])
+		if 4+olen > len(rdata) {
+			break
+		}
+		if ocode == int(code) {
+			return rdata[4 : 4+olen], true
+		}
+		rdata = rdata[4+olen:]
+	}
+	return "", false
+}
+
+// getRCode returns the extended RCODE of res,
+// or -1 if res is too short to have a header.
+func getRCode(res string) int {
+	if len(res) < 12 { // header size
+		return -1
+	}
+	rcode := int(res[3] & 0xf)
+	if opt, _, ok := findOPT(res); ok && opt >= 0 {
+		// the upper 8 bits are in the TTL field
+		rcode |= int(res[opt+4]) << 4
+	}
+	return rcode
+}
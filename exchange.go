@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Exchange sends a DNS query message using the resolver r, and returns the response.
+//
+// The query is sent through a connection obtained from r.Dial, with an empty address.
+// Resolvers created by this package ignore the address, and so can be used.
+func Exchange(ctx context.Context, r *net.Resolver, query []byte) ([]byte, error) {
+	if r == nil || r.Dial == nil {
+		return nil, errNoDial
+	}
+	res, err := exchange(ctx, r.Dial, "tcp", "", string(query))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(res), nil
+}
+
+// ExchangeBatch is like [Exchange], but sends multiple queries
+// pipelined over a single connection, matching responses to queries by message ID.
+// Responses are returned in the same order as queries.
+// Over resolvers created by this package, like DoH resolvers, queries are sent concurrently,
+// so the batch takes about as long as its slowest query.
+//
+// If the connection fails before all responses are received
+// (for instance, because the server does not support pipelining),
+// remaining queries are sent one at a time.
+func ExchangeBatch(ctx context.Context, r *net.Resolver, queries [][]byte) ([][]byte, error) {
+	if r == nil || r.Dial == nil {
+		return nil, errNoDial
+	}
+
+	responses := make([][]byte, len(queries))
+	pipeline(ctx, r.Dial, queries, responses)
+
+	// fallback to sequential exchanges
+	for i, res := range responses {
+		if res != nil {
+			continue
+		}
+		res, err := exchange(ctx, r.Dial, "tcp", "", string(queries[i]))
+		if err != nil {
+			return nil, err
+		}
+		responses[i] = []byte(res)
+	}
+	return responses, nil
+}
+
+var errNoDial = errors.New("dns: resolver has no Dial function")
+
+// pipelineWindow is the maximum number of queries in flight on a pipelined connection.
+const pipelineWindow = 32
+
+func pipeline(ctx context.Context, dial DialFunc, queries, responses [][]byte) {
+	conn, cancel, err := dialConn(ctx, dial, "tcp", "")
+	if err != nil {
+		return
+	}
+	defer cancel()
+
+	// message IDs are replaced by (truncated) indexes,
+	// which are unique among queries in flight
+	inflight := make(map[uint16]int, pipelineWindow)
+	next := 0
+
+	for next < len(queries) || len(inflight) > 0 {
+		// send queries
+		for next < len(queries) && len(inflight) < pipelineWindow {
+			query := queries[next]
+			if len(query) < 12 {
+				// leave it for the fallback
+				next++
+				continue
+			}
+			id := uint16(next)
+			err := writeMessage(conn, string([]byte{byte(id >> 8), byte(id)})+string(query[2:]))
+			if err != nil {
+				return
+			}
+			inflight[id] = next
+			next++
+		}
+		if len(inflight) == 0 {
+			return
+		}
+
+		// read a response
+		res, err := readMessage(conn)
+		if err != nil || len(res) < 12 {
+			return
+		}
+		id := uint16(getUint16(res))
+		i, ok := inflight[id]
+		if !ok {
+			return
+		}
+		delete(inflight, id)
+
+		// restore the message ID
+		responses[i] = append([]byte{queries[i][0], queries[i][1]}, res[2:]...)
+	}
+}
@@ -0,0 +1,118 @@
+package dns_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/ncruces/go-dns"
+)
+
+func TestExchangeBatch(t *testing.T) {
+	dial := pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	queries := make([][]byte, 100)
+	for i := range queries {
+		queries[i] = newQuery(t, uint16(1000+i), "example.com.", dnsmessage.TypeA)
+	}
+
+	tests := map[string]dns.DialFunc{
+		"Pipelined": dial,
+		"Sequential": func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := dial(ctx, network, address)
+			return &oneWriteConn{Conn: conn}, err
+		},
+	}
+
+	for name, dial := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := &net.Resolver{PreferGo: true, Dial: dial}
+
+			responses, err := dns.ExchangeBatch(context.TODO(), r, queries)
+			if err != nil {
+				t.Fatalf("ExchangeBatch(...) error = %v", err)
+			}
+
+			for i, res := range responses {
+				var msg dnsmessage.Message
+				if err := msg.Unpack(res); err != nil {
+					t.Fatalf("Unpack(...) error = %v", err)
+				}
+				if msg.ID != uint16(1000+i) || len(msg.Answers) != 1 {
+					t.Errorf("ExchangeBatch(...)[%d] = %v", i, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestExchangeBatch_concurrent(t *testing.T) {
+	// each query waits for the other
+	var wg sync.WaitGroup
+	wg.Add(2)
+	r := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		wg.Done()
+		done := make(chan struct{})
+		go func() { wg.Wait(); close(done) }()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return dns.BuildResponse(query, dnsmessage.RCodeSuccess)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	queries := [][]byte{
+		newQuery(t, 1, "example.com.", dnsmessage.TypeA),
+		newQuery(t, 2, "example.com.", dnsmessage.TypeAAAA),
+	}
+	responses, err := dns.ExchangeBatch(ctx, r, queries)
+	if err != nil {
+		t.Fatalf("ExchangeBatch(...) error = %v", err)
+	}
+	for i, res := range responses {
+		if len(res) < 2 || res[0] != queries[i][0] || res[1] != queries[i][1] {
+			t.Errorf("ExchangeBatch(...)[%d] = %x", i, res)
+		}
+	}
+}
+
+// oneWriteConn fails all writes but the first.
+type oneWriteConn struct {
+	net.Conn
+	written bool
+}
+
+func (c *oneWriteConn) Write(b []byte) (int, error) {
+	if c.written {
+		return 0, errors.New("pipelining not supported")
+	}
+	c.written = true
+	return c.Conn.Write(b)
+}
+
+func newQuery(t testing.TB, id uint16, name string, typ dnsmessage.Type) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
@@ -0,0 +1,17 @@
+//go:build linux
+
+package dns
+
+import "syscall"
+
+// tcpFastOpenConnect is the TCP_FASTOPEN_CONNECT socket option (Linux 4.11).
+// It defers the SYN until the first write, so that it carries the TLS ClientHello.
+const tcpFastOpenConnect = 0x1e
+
+// fastOpenControl enables TCP Fast Open on the socket, if the kernel supports it.
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		// older kernels fail with ENOPROTOOPT; connect normally
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	})
+}
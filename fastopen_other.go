@@ -0,0 +1,10 @@
+//go:build !linux
+
+package dns
+
+import "syscall"
+
+// fastOpenControl does nothing: TCP Fast Open is only supported on Linux.
+func fastOpenControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
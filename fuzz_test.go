@@ -1,7 +1,10 @@
 package dns
 
 import (
+	"math"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
@@ -13,13 +16,28 @@ func Fuzz_parsing(f *testing.F) {
 	f.Add("000000000000", "00\x80000000000")
 	f.Add("00\x00000000000", "00\x80000000000")
 	f.Add("00\x00000000000", "00\x80100000000")
+	f.Add("\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x01a\x00\x00\x01\x00\x01",
+		"\x00\x00\x81\x80\x00\x01\x00\x00\x00\x00\x00\x00\x01A\x00\x00\x01\x00\x01")
+	f.Add("\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x01a\x00\x00\x01\x00\x01",
+		"\x00\x00\x81\x80\x00\x01\x00\x00\x00\x00\x00\x00\x01b\x00\x00\x01\x00\x01")
+	f.Add("\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x01a\x00\x00\x01\x00\x01",
+		"\x00\x00\x81\x80\x00\x01\x00\x00\x00\x00\x00\x00\x01a\x00\x00\x1c\x00\x01")
+	f.Add("\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		"\x00\x00\x81\x80\x00\x00\x00\x00\x00\x00\x00\x00")
+	f.Add("\x00\x00\x01\x00\x00\x02\x00\x00\x00\x00\x00\x00\x01a\x00\x00\x01\x00\x01\x01b\x00\x00\x01\x00\x01",
+		"\x00\x00\x81\x80\x00\x02\x00\x00\x00\x00\x00\x00\x01a\x00\x00\x01\x00\x01\x01b\x00\x00\x01\x00\x01")
 
 	f.Fuzz(func(t *testing.T, req string, res string) {
-		var parser dnsmessage.Parser
+		var preq, pres dnsmessage.Parser
 
 		invalid := invalid(req, res)
-		hreq, ereq := parser.Start([]byte(req))
-		hres, eres := parser.Start([]byte(res))
+		if len(req) >= 12 {
+			if _, end := cacheKey(req); end > len(req) {
+				t.Fail()
+			}
+		}
+		hreq, ereq := preq.Start([]byte(req))
+		hres, eres := pres.Start([]byte(res))
 
 		if !invalid {
 			if ereq != nil || eres != nil { // header size
@@ -40,9 +58,165 @@ func Fuzz_parsing(f *testing.F) {
 			if hres.RCode != 0 && hres.RCode != dnsmessage.RCodeNameError { // no error, or name error
 				t.Fail()
 			}
+			if getUint16(req[4:]) != 1 { // single question
+				t.Fail()
+			}
 			if nameError(res) != (hres.RCode == dnsmessage.RCodeNameError) { // name error
 				t.Fail()
 			}
+
+			qreq, ereq := preq.AllQuestions()
+			qres, eres := pres.AllQuestions()
+			if ereq == nil && eres == nil { // same questions
+				if len(qreq) != len(qres) {
+					t.Fail()
+				}
+				for i := range qreq {
+					if !strings.EqualFold(qreq[i].Name.String(), qres[i].Name.String()) ||
+						qreq[i].Type != qres[i].Type || qreq[i].Class != qres[i].Class {
+						t.Fail()
+					}
+				}
+			}
+		}
+	})
+}
+
+func Fuzz_getTTL(f *testing.F) {
+	f.Add("\x00\x00\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00\x01a\x00\x00\x01\x00\x01" +
+		"\xc0\x0c\x00\x01\x00\x01\x00\x00\x00\x3c\x00\x04\xc0\x00\x02\x01")
+	f.Add("\x00\x00\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00\xc0\x0c\x00\x01\x00\x01" +
+		"\xc0\x0c\x00\x01\x00\x01\x00\x00\x00\x3c\x00\x04\xc0\x00\x02\x01")
+	f.Add("\x00\x00\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00\x01a\x00\x00\x01\x00\x01" +
+		"\x01a\xc0\x0c\x00\x01\x00\x01\x00\x00\x00\x3c\x00\x04\xc0\x00\x02")
+	f.Add("\x00\x00\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00\x01a\x00\x00\x01\x00\x01" +
+		"\xc0\x0c\x00\x01\x00\x01\x00\x00\x00\x3c\xff\xff\xc0\x00\x02\x01")
+	f.Add("\x00\x00\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00\x01a\x00\x00\x01\x00\x01\xc0")
+
+	f.Fuzz(func(t *testing.T, msg string) {
+		if len(msg) < 12 {
+			return
+		}
+
+		// must not panic
+		getTTL(msg)
+
+		// check the canonical form of valid messages
+		var m dnsmessage.Message
+		if err := m.Unpack([]byte(msg)); err != nil {
+			return
+		}
+		buf, err := m.Pack()
+		if err != nil {
+			return
+		}
+		want := math.MaxInt32
+		for _, rrs := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+			for _, rr := range rrs {
+				if rr.Header.Type != dnsmessage.TypeOPT && int(rr.Header.TTL) < want {
+					want = int(rr.Header.TTL)
+				}
+			}
+		}
+		if m.RCode == dnsmessage.RCodeNameError || len(m.Answers) == 0 {
+			for _, rr := range m.Authorities {
+				if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok && int(soa.MinTTL) < want {
+					want = int(soa.MinTTL)
+				}
+			}
+		}
+		if got := getTTL(string(buf)); got != time.Duration(want)*time.Second {
+			t.Errorf("getTTL(...) = %v, wanted %v", got, time.Duration(want)*time.Second)
+		}
+	})
+}
+
+func Fuzz_setEDNSBufSize(f *testing.F) {
+	f.Add("")
+	f.Add("\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x01a\x00\x00\x01\x00\x01")
+	f.Add("\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x01\x01a\x00\x00\x01\x00\x01" +
+		"\x00\x00\x29\x04\xd0\x00\x00\x00\x00\x00\x00")
+	f.Add("0000\x00\x01\x00\x00\x00\x00\x00\x01\x000000\x00\x00\x0500000000\x00")
+
+	f.Fuzz(func(t *testing.T, req string) {
+		var msg dnsmessage.Message
+		if err := msg.Unpack([]byte(req)); err != nil {
+			return
+		}
+
+		res := setEDNSBufSize(req, 4096)
+		if _, _, ok := findOPT(req); !ok {
+			// dnsmessage is more lenient than findOPT
+			if res != req {
+				t.Errorf("rewrote unparseable message %q to %q", req, res)
+			}
+			return
+		}
+		if err := msg.Unpack([]byte(res)); err != nil {
+			t.Fatal(err)
+		}
+		for _, rr := range msg.Additionals {
+			if rr.Header.Type == dnsmessage.TypeOPT && rr.Header.Class == 4096 {
+				return
+			}
+		}
+		t.Fail()
+	})
+}
+
+func Fuzz_rewrite(f *testing.F) {
+	f.Add("", "")
+	f.Add("\x00\x00", "\x00")
+	f.Add("\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x01a\x00\x00\x01\x00\x01", "")
+	f.Add("\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x01\x01a\x00\x00\x01\x00\x01"+
+		"\x00\x00\x29\x04\xd0\x00\x00\x00\x00\x00\x0c\x00\x0a\x00\x08\x01\x02\x03\x04\x05\x06\x07\x08", "\x00")
+	f.Add("\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x01\x01a\x00\x00\x01\x00\x01"+
+		"\x00\x00\x29\x04\xd0\x00\x00\x00\x00\xff\xff\x00\x0a\x00\x08", "\x01")
+	f.Add("\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x01\x01a\x00\x00\x01\x00\x01"+
+		"\x00\x00\x29\x04\xd0\x00\x00\x00\x00\x00\x08\x00\x0a\x00\x08\x01\x02\x03\x04\x05\x06\x07\x08", "\x01")
+
+	f.Fuzz(func(t *testing.T, msg string, data string) {
+		var m dnsmessage.Message
+		valid := m.Unpack([]byte(msg)) == nil
+		_, _, parsed := findOPT(msg)
+
+		// rewriting passes unparseable messages through,
+		// and keeps valid messages valid
+		for _, got := range []string{
+			setEDNSBufSize(msg, 4096),
+			addEDNSOption(msg, ednsCookie, data),
+			newCookieJar(cryptoRand).attach(msg, "192.0.2.1:53"),
+			ageTTLs(msg, 30, 60),
+			normalizeNoData(msg, msg),
+		} {
+			if !parsed && got != msg {
+				t.Errorf("rewrote unparseable message %q to %q", msg, got)
+			}
+			if valid {
+				if err := m.Unpack([]byte(got)); err != nil {
+					t.Errorf("rewrote valid message %q to %q: %v", msg, got, err)
+				}
+			}
+		}
+
+		// randomizing case preserves cache keys
+		if len(msg) >= 12 {
+			got, _ := randomizeCase(msg, cryptoRand)
+			want, _ := cacheKey(msg)
+			if key, _ := cacheKey(got); key != want {
+				t.Errorf("randomized %q to %q", msg, got)
+			}
+		}
+
+		// inspecting unparseable messages reports nothing
+		if _, ok := getEDNSOption(msg, ednsCookie); ok && !parsed {
+			t.Errorf("found option in unparseable message %q", msg)
+		}
+		if err := newCookieJar(cryptoRand).check(msg, "192.0.2.1:53"); err != nil && !parsed {
+			t.Errorf("rejected unparseable message %q: %v", msg, err)
+		}
+		if rcode := getRCode(msg); len(msg) < 12 && rcode >= 0 {
+			t.Errorf("got RCODE %d for message %q", rcode, msg)
 		}
 	})
 }
@@ -0,0 +1,204 @@
+package dns
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// LookupSOA returns the SOA record for the given name, using the resolver r.
+// If name exists, but isn't a zone apex, the SOA record of its zone is returned,
+// from the authority section of the response; if name doesn't exist, the error is not found.
+// Resolvers created by this package can be used, see [Exchange].
+func LookupSOA(ctx context.Context, r *net.Resolver, name string) (*dnsmessage.SOAResource, error) {
+	res, err := lookup(ctx, r, name, dnsmessage.TypeSOA)
+	if err != nil {
+		return nil, err
+	}
+	for _, rr := range res.Answers {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			return soa, nil
+		}
+	}
+	// NODATA carries the SOA record of the zone (RFC 2308)
+	for _, rr := range res.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			return soa, nil
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// An IPAddrTTL is an IP address, with its time-to-live.
+type IPAddrTTL struct {
+	net.IPAddr
+	TTL time.Duration
+}
+
+// LookupIPAddrTTL is like [net.Resolver.LookupIPAddr], but also returns the TTL of each address,
+// using the resolver r. A and AAAA records are queried concurrently.
+// Resolvers created by this package can be used, see [Exchange].
+func LookupIPAddrTTL(ctx context.Context, r *net.Resolver, host string) ([]IPAddrTTL, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return []IPAddrTTL{{IPAddr: net.IPAddr{IP: ip.AsSlice(), Zone: ip.Zone()}}}, nil
+	}
+
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([]*dnsmessage.Message, len(types))
+	errs := make([]error, len(types))
+
+	var wg sync.WaitGroup
+	for i, typ := range types {
+		wg.Add(1)
+		go func(i int, typ dnsmessage.Type) {
+			defer wg.Done()
+			results[i], errs[i] = lookup(ctx, r, host, typ)
+		}(i, typ)
+	}
+	wg.Wait()
+
+	var addrs []IPAddrTTL
+	for _, res := range results {
+		if res == nil {
+			continue
+		}
+		for _, rr := range res.Answers {
+			ttl := time.Duration(rr.Header.TTL) * time.Second
+			switch body := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, IPAddrTTL{IPAddr: net.IPAddr{IP: body.A[:]}, TTL: ttl})
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, IPAddrTTL{IPAddr: net.IPAddr{IP: body.AAAA[:]}, TTL: ttl})
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// Warm resolves names for each of the given types concurrently using the resolver r,
+// so that a caching resolver answers later lookups from the cache.
+// Concurrency is bounded; use [MaxConcurrentQueries] to further limit queries to upstream.
+// Failures don't abort the batch; if any query fails, a [WarmError] is returned.
+// Resolvers created by this package can be used, see [Exchange].
+func Warm(ctx context.Context, r *net.Resolver, names []string, types []dnsmessage.Type) error {
+	var mtx sync.Mutex
+	var errs WarmError
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, warmConcurrency)
+
+	for _, name := range names {
+		for _, typ := range types {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(name string, typ dnsmessage.Type) {
+				defer func() { <-sem; wg.Done() }()
+				if _, err := lookup(ctx, r, name, typ); err != nil {
+					mtx.Lock()
+					errs = append(errs, err)
+					mtx.Unlock()
+				}
+			}(name, typ)
+		}
+	}
+	wg.Wait()
+
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// warmConcurrency is the maximum number of concurrent queries made by Warm.
+const warmConcurrency = 32
+
+// A WarmError reports the queries that failed to resolve, see [Warm].
+type WarmError []error
+
+func (e WarmError) Error() string {
+	var str strings.Builder
+	for i, err := range e {
+		if i > 0 {
+			str.WriteString("; ")
+		}
+		str.WriteString(err.Error())
+	}
+	return str.String()
+}
+
+// lookup sends a query for name and type, and parses the response.
+// Queries are built like those of the Go resolver, so they share cache entries.
+// Names are fully qualified, so the search list doesn't apply.
+func lookup(ctx context.Context, r *net.Resolver, name string, typ dnsmessage.Type) (*dnsmessage.Message, error) {
+	fqdn := name
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	n, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+
+	var id [2]byte
+	if _, err := crand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(DefaultEDNSBufSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	req := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               binary.BigEndian.Uint16(id[:]),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  n,
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		}},
+		Additionals: []dnsmessage.Resource{{
+			Header: opt,
+			Body:   &dnsmessage.OPTResource{},
+		}},
+	}
+	query, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := Exchange(ctx, r, query)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: name}
+	}
+
+	var res dnsmessage.Message
+	if err := res.Unpack(buf); err != nil {
+		return nil, &net.DNSError{Err: "cannot unmarshal DNS message", Name: name}
+	}
+	if res.ID != req.ID || !res.Response {
+		return nil, &net.DNSError{Err: "invalid DNS response", Name: name}
+	}
+	switch res.RCode {
+	case dnsmessage.RCodeSuccess:
+		return &res, nil
+	case dnsmessage.RCodeNameError:
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+}
@@ -0,0 +1,214 @@
+package dns_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/ncruces/go-dns"
+)
+
+func TestLookupSOA(t *testing.T) {
+	want := dnsmessage.SOAResource{
+		NS:      dnsmessage.MustNewName("ns.example.com."),
+		MBox:    dnsmessage.MustNewName("hostmaster.example.com."),
+		Serial:  2024010101,
+		Refresh: 7200,
+		Retry:   3600,
+		Expire:  1209600,
+		MinTTL:  300,
+	}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			res := answer(req, 60)
+			soa := []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{
+					Name:  dnsmessage.MustNewName("example.com."),
+					Type:  dnsmessage.TypeSOA,
+					Class: dnsmessage.ClassINET,
+					TTL:   3600,
+				},
+				Body: &want,
+			}}
+			switch req.Questions[0].Name.String() {
+			case "example.com.":
+				res.RCode = dnsmessage.RCodeSuccess
+				res.Answers = soa
+			case "www.example.com.":
+				// NODATA, with the zone SOA in the authority section
+				res.RCode = dnsmessage.RCodeSuccess
+				res.Authorities = soa
+			case "nodata.example.com.":
+				// NODATA, without an SOA record
+				res.RCode = dnsmessage.RCodeSuccess
+				res.Authorities = nil
+			}
+			return res
+		}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	soa, err := dns.LookupSOA(ctx, r, "example.com")
+	if err != nil {
+		t.Fatalf("LookupSOA('example.com') error = %v", err)
+	}
+	if !check(*soa, want) {
+		t.Errorf("LookupSOA('example.com') = %v, wanted %v", soa, &want)
+	}
+
+	soa, err = dns.LookupSOA(ctx, r, "www.example.com")
+	if err != nil {
+		t.Fatalf("LookupSOA('www.example.com') error = %v", err)
+	}
+	if !check(*soa, want) {
+		t.Errorf("LookupSOA('www.example.com') = %v, wanted %v", soa, &want)
+	}
+
+	for _, name := range []string{"nxdomain.example.com", "nodata.example.com"} {
+		_, err = dns.LookupSOA(ctx, r, name)
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("LookupSOA(%q) error = %v", name, err)
+		}
+	}
+}
+
+func TestLookupIPAddrTTL(t *testing.T) {
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			if req.Questions[0].Name.String() != "example.com." {
+				return answer(req, 60)
+			}
+			if req.Questions[0].Type == dnsmessage.TypeA {
+				return answer(req, 60, "192.0.2.1")
+			}
+			return answer(req, 300, "2001:db8::1")
+		}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs, err := dns.LookupIPAddrTTL(ctx, r, "example.com")
+	if err != nil {
+		t.Fatalf("LookupIPAddrTTL('example.com') error = %v", err)
+	}
+	got := map[string]time.Duration{}
+	for _, a := range addrs {
+		got[a.String()] = a.TTL
+	}
+	want := map[string]time.Duration{
+		"192.0.2.1":   time.Minute,
+		"2001:db8::1": 5 * time.Minute,
+	}
+	if !check(got, want) {
+		t.Errorf("LookupIPAddrTTL('example.com') = %v, wanted %v", got, want)
+	}
+
+	_, err = dns.LookupIPAddrTTL(ctx, r, "nxdomain.example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupIPAddrTTL('nxdomain.example.com') error = %v", err)
+	}
+
+	addrs, err = dns.LookupIPAddrTTL(ctx, r, "192.0.2.2")
+	if err != nil || len(addrs) != 1 || addrs[0].String() != "192.0.2.2" {
+		t.Errorf("LookupIPAddrTTL('192.0.2.2') = %v, %v", addrs, err)
+	}
+}
+
+func TestLookup_shortNames(t *testing.T) {
+	var mtx sync.Mutex
+	var names []string
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			mtx.Lock()
+			names = append(names, req.Questions[0].Name.String())
+			mtx.Unlock()
+			return answer(req, 60, "192.0.2.1")
+		}),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	expect := func(wanted string) {
+		t.Helper()
+		mtx.Lock()
+		defer mtx.Unlock()
+		for _, n := range names {
+			if n != wanted {
+				t.Errorf("queried %q, wanted only %q", n, wanted)
+			}
+		}
+		names = nil
+	}
+
+	// short names are fully qualified, never expanded with the search list
+	if _, err := dns.LookupIPAddrTTL(ctx, r, "host"); err != nil {
+		t.Fatalf("LookupIPAddrTTL('host') error = %v", err)
+	}
+	expect("host.")
+
+	// rooted names are never expanded
+	if _, err := r.LookupIPAddr(ctx, "other."); err != nil {
+		t.Fatalf("LookupIPAddr('other.') error = %v", err)
+	}
+	expect("other.")
+
+	// both share a cache entry
+	if _, err := r.LookupIPAddr(ctx, "host."); err != nil {
+		t.Fatalf("LookupIPAddr('host.') error = %v", err)
+	}
+	expect("")
+}
+
+func TestWarm(t *testing.T) {
+	zone := newTestZone()
+	zone.addHost("a.example.com.", "192.0.2.1", "2001:db8::1")
+	zone.addHost("b.example.com.", "192.0.2.2")
+
+	var queries atomic.Int32
+	r := dns.NewCachingResolver(&net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			queries.Add(1)
+			return zone.handler(req)
+		}),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	names := []string{"a.example.com", "b.example.com", "nxdomain.test"}
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	err := dns.Warm(ctx, r, names, types)
+	var warmErr dns.WarmError
+	if !errors.As(err, &warmErr) || len(warmErr) != 2 {
+		t.Errorf("Warm(...) error = %v", err)
+	}
+	if n := queries.Load(); n != 6 {
+		t.Errorf("got %d queries, wanted 6", n)
+	}
+
+	// lookups are answered from the cache
+	for _, name := range names[:2] {
+		if _, err := r.LookupIPAddr(ctx, name); err != nil {
+			t.Errorf("LookupIPAddr(%q) error = %v", name, err)
+		}
+	}
+	if n := queries.Load(); n != 6 {
+		t.Errorf("got %d queries, wanted 6", n)
+	}
+}
@@ -0,0 +1,224 @@
+package dns
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// BuildResponse builds a response to the DNS query message,
+// with the given RCODE and answer records.
+func BuildResponse(query []byte, rcode dnsmessage.RCode, answers ...dnsmessage.Resource) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			OpCode:             h.OpCode,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: questions,
+		Answers:   answers,
+	}
+	return msg.Pack()
+}
+
+// MessageTTL returns how long the DNS response message msg can be cached:
+// the minimum TTL of its records, ignoring EDNS OPT records.
+// Negative responses (NXDOMAIN, or NODATA) are also bounded
+// by the MINIMUM field of the SOA record in the authority section (RFC 2308).
+//
+// Truncated messages, messages with an RCODE other than NOERROR or NXDOMAIN,
+// and messages without answer or authority records are uncacheable, and return an error.
+// This is the TTL the resolver cache uses, before applying [MinCacheTTL] and [MaxCacheTTL].
+func MessageTTL(msg []byte) (time.Duration, error) {
+	return messageTTL(string(msg))
+}
+
+// messageTTL is [MessageTTL], used by the resolver cache.
+func messageTTL(res string) (time.Duration, error) {
+	if len(res) < 12 { // header size
+		return 0, errMalformed
+	}
+	if res[2]&0xfa != 0x80 { // standard query response, not truncated
+		return 0, errUncacheable
+	}
+	if res[3]&0xf != 0 && res[3]&0xf != 3 { // no error, or name error
+		return 0, errUncacheable
+	}
+	if getUint16(res[6:])+getUint16(res[8:]) == 0 { // answers, or authority
+		return 0, errUncacheable
+	}
+	ttl := getTTL(res)
+	if ttl < 0 {
+		return 0, errMalformed
+	}
+	return ttl, nil
+}
+
+var (
+	errMalformed   = errors.New("dns: malformed message")
+	errUncacheable = errors.New("dns: uncacheable message")
+)
+
+// setCheckingDisabled returns req with the CD bit set.
+func setCheckingDisabled(req string) string {
+	if len(req) < 12 { // header size
+		return req
+	}
+	return req[:3] + string([]byte{req[3] | 0x10}) + req[4:]
+}
+
+// randomizeCase returns req with the letters of question names in random case (DNS 0x20),
+// and the end offset of the questions, or -1.
+func randomizeCase(req string, rand randFunc) (string, int) {
+	if len(req) < 12 { // header size
+		return req, -1
+	}
+	var bits uint64
+	var n int
+	return mapNames(req, func(c byte) byte {
+		if l := c | 0x20; l < 'a' || l > 'z' {
+			return c
+		}
+		if n == 0 {
+			bits, n = rand(), 64
+		}
+		bit := bits & 1
+		bits >>= 1
+		n--
+		return c ^ byte(bit<<5)
+	})
+}
+
+// ageTTLs returns res with record TTLs capped at max, then decreased by age, down to zero.
+// Unparseable messages are returned unchanged.
+func ageTTLs(res string, age, max uint32) string {
+	if len(res) < 12 { // header size
+		return res
+	}
+
+	qdcount := getUint16(res[4:])
+	ancount := getUint16(res[6:])
+	nscount := getUint16(res[8:])
+	arcount := getUint16(res[10:])
+	rdcount := ancount + nscount + arcount
+
+	buf := []byte(res)
+	i := 12 // skip header
+
+	// skip questions
+	for n := 0; n < qdcount; n++ {
+		name := getNameLen(res[i:])
+		if name < 0 || i+name+4 > len(res) {
+			return res
+		}
+		i += name + 4
+	}
+
+	// update records
+	for n := 0; n < rdcount; n++ {
+		name := getNameLen(res[i:])
+		if name < 0 || i+name+10 > len(res) {
+			return res
+		}
+		rtyp := getUint16(res[i+name:])
+		rlen := getUint16(res[i+name+8:])
+		// skip EDNS OPT since it doesn't have a TTL
+		if rtyp != 41 {
+			ttl := uint32(getUint32(res[i+name+4:]))
+			if ttl > max {
+				ttl = max
+			}
+			if ttl > age {
+				ttl -= age
+			} else {
+				ttl = 0
+			}
+			buf[i+name+4] = byte(ttl >> 24)
+			buf[i+name+5] = byte(ttl >> 16)
+			buf[i+name+6] = byte(ttl >> 8)
+			buf[i+name+7] = byte(ttl)
+		}
+		i += name + 10 + rlen
+		if i > len(res) {
+			return res
+		}
+	}
+	return string(buf)
+}
+
+// validResponse reports whether res is a well-formed response to req.
+func validResponse(req, res string) bool {
+	if len(req) < 12 || len(res) < 12 { // header size
+		return false
+	}
+	if req[0] != res[0] || req[1] != res[1] || res[2] < 0x80 { // IDs match, response
+		return false
+	}
+	if !sameQuestions(req, res) { // same questions
+		return false
+	}
+	_, _, ok := findOPT(res) // records parse
+	return ok
+}
+
+// normalizeNoData returns res with the RA bit set, if res is a NODATA response to req (RFC 2308):
+// NOERROR, with no answers, and an SOA record in the authority section.
+// Without the RA and AA bits, the Go resolver takes these for lame referrals,
+// and fails with "lame referral" or "server misbehaving", instead of "no such host".
+// Other messages are returned unchanged.
+func normalizeNoData(req, res string) string {
+	if len(req) < 12 || len(res) < 12 { // header size
+		return res
+	}
+	if res[2]&0x84 != 0x80 || res[3]&0x8f != 0 { // response, not AA, not RA, NOERROR
+		return res
+	}
+	if getUint16(res[6:]) != 0 || !sameQuestions(req, res) { // no answers, same questions
+		return res
+	}
+
+	qdcount := getUint16(res[4:])
+	nscount := getUint16(res[8:])
+	i := 12 // skip header
+
+	// skip questions
+	for n := 0; n < qdcount; n++ {
+		name := getNameLen(res[i:])
+		if name < 0 || i+name+4 > len(res) {
+			return res
+		}
+		i += name + 4
+	}
+
+	// look for an SOA record
+	for n := 0; n < nscount; n++ {
+		name := getNameLen(res[i:])
+		if name < 0 || i+name+10 > len(res) {
+			return res
+		}
+		rtyp := getUint16(res[i+name:])
+		rlen := getUint16(res[i+name+8:])
+		i += name + 10 + rlen
+		if i > len(res) {
+			return res
+		}
+		if rtyp == 6 {
+			return res[:3] + string([]byte{res[3] | 0x80}) + res[4:]
+		}
+	}
+	return res
+}
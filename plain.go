@@ -0,0 +1,366 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// NewPlainResolver creates an unencrypted DNS resolver that uses the given servers.
+// The addresses should be IP addresses, network addresses of the form "IP:port",
+// or paths to Unix domain sockets of the form "unix:/path", like those of local stub resolvers.
+// Servers are tried in order, failing over to the next one on errors.
+//
+// Queries are sent over UDP, falling back to TCP for truncated responses.
+// Unix domain sockets are stream sockets, framed like TCP.
+func NewPlainResolver(addresses []string, options ...PlainOption) (*net.Resolver, error) {
+	// apply options
+	opts := plainOpts{servfail: 1}
+	for _, o := range options {
+		o.apply(&opts)
+	}
+
+	// server network addresses
+	var addrs addrList
+	for _, a := range addresses {
+		if strings.HasPrefix(a, "unix:") {
+			if err := checkSocket(strings.TrimPrefix(a, "unix:")); err != nil {
+				return nil, fmt.Errorf("dns: invalid address %q: %w", a, err)
+			}
+			addrs.addrs = append(addrs.addrs, a)
+			continue
+		}
+		a, err := normalizeAddrs([]string{a}, "53")
+		if err != nil {
+			return nil, err
+		}
+		addrs.addrs = append(addrs.addrs, a...)
+	}
+	if len(addrs.addrs) == 0 {
+		return nil, errNoAddresses
+	}
+	addrs.latency = opts.latency
+
+	// setup cookies
+	rand := randFunc(opts.rand)
+	if rand == nil {
+		rand = cryptoRand
+	}
+	var cookies *cookieJar
+	if opts.cookies {
+		cookies = newCookieJar(rand)
+	}
+
+	// exchange messages with a server
+	query := func(ctx context.Context, addr, req string) (string, error) {
+		// randomize the case of names
+		orig, end := req, -1
+		if opts.x20 {
+			req, end = randomizeCase(req, rand)
+		}
+
+		send := func(ctx context.Context, network string) (string, error) {
+			address := addr
+			if strings.HasPrefix(addr, "unix:") {
+				network, address = "unix", strings.TrimPrefix(addr, "unix:")
+			}
+			if cookies == nil {
+				return exchange(ctx, opts.dialFunc, network, address, req)
+			}
+			res, err := exchange(ctx, opts.dialFunc, network, address, cookies.attach(req, addr))
+			if err != nil {
+				return "", err
+			}
+			return res, cookies.check(res, addr)
+		}
+
+		udp := func(ctx context.Context) (string, error) {
+			res, err := send(ctx, "udp")
+			if err == nil && cookies != nil && getRCode(res) == rcodeBadCookie {
+				// retry with the new server cookie
+				res, err = send(ctx, "udp")
+			}
+			return res, err
+		}
+		tcp := func(ctx context.Context) (string, error) {
+			return send(ctx, "tcp")
+		}
+
+		var res string
+		var err error
+		if opts.tcp {
+			res, err = tcp(ctx)
+		} else if opts.fallback > 0 && opts.fallback < 1 && !strings.HasPrefix(addr, "unix:") {
+			res, err = fallback(ctx, fallbackDelay(ctx, opts.fallback), udp, tcp)
+		} else {
+			res, err = udp(ctx)
+		}
+		if err == nil && truncated(res) {
+			res, err = tcp(ctx)
+		}
+		if err == nil && end > 12 {
+			// check that the case was echoed, and restore it
+			if len(res) < end || res[12:end] != req[12:end] {
+				return "", errCaseMismatch
+			}
+			res = res[:12] + orig[12:end] + res[end:]
+		}
+		return res, err
+	}
+
+	// exchange messages, failing over on errors
+	servers := len(addrs.addrs)
+	roundTrip := func(ctx context.Context, req string) (string, error) {
+		// rewrite query
+		if opts.edns != 0 {
+			req = setEDNSBufSize(req, opts.edns)
+		}
+		if opts.cd {
+			req = setCheckingDisabled(req)
+		}
+
+		for i := 0; ; i++ {
+			addr, err := addrs.get(ctx)
+			if err != nil {
+				return "", err
+			}
+			start := time.Now()
+			res, err := query(ctx, addr, req)
+			if err != nil {
+				addrs.failed(addr)
+				return "", err
+			}
+			addrs.observe(addr, time.Since(start))
+			if getRCode(res) != rcodeServFail || i >= opts.servfail || i >= servers-1 {
+				addrs.succeeded()
+				return res, nil
+			}
+
+			// retry the next server, with exponential backoff
+			addrs.failed(addr)
+			timer := time.NewTimer(plainBackoff << i)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return "", ctx.Err()
+			}
+		}
+	}
+
+	// create the resolver
+	var resolver = net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn := &dnsConn{maxQueue: opts.maxQueue}
+			conn.roundTrip = roundTrip
+			return conn, nil
+		},
+	}
+
+	// setup caching
+	if opts.cache {
+		resolver.Dial = NewCachingDialer(resolver.Dial, withMaxQueue(opts.cacheOpts, opts.maxQueue)...)
+		resolver.StrictErrors = strictErrors(opts.cacheOpts, false)
+	}
+
+	return &resolver, nil
+}
+
+// A PlainOption customizes the plain DNS resolver.
+type PlainOption interface {
+	apply(*plainOpts)
+}
+
+type plainOpts struct {
+	cache     bool
+	cacheOpts []CacheOption
+	dialFunc  DialFunc
+	cookies   bool
+	servfail  int
+	fallback  float64
+	x20       bool
+	latency   bool
+	tcp       bool
+	rand      RandSource
+	maxQueue  int
+	edns      uint16
+	cd        bool
+}
+
+type (
+	plainCache    []CacheOption
+	plainDialFunc DialFunc
+	plainCookies  struct{}
+	plainServfail int
+	plainFallback float64
+	plain0x20     struct{}
+	plainLatency  struct{}
+	plainTCP      struct{}
+	plainRand     RandSource
+	plainMaxQueue int
+	plainEDNS     uint16
+	plainCD       struct{}
+)
+
+func (o plainCache) apply(t *plainOpts)    { t.cache = true; t.cacheOpts = ([]CacheOption)(o) }
+func (o plainDialFunc) apply(t *plainOpts) { t.dialFunc = (DialFunc)(o) }
+func (o plainCookies) apply(t *plainOpts)  { t.cookies = true }
+func (o plainServfail) apply(t *plainOpts) { t.servfail = int(o) }
+func (o plainFallback) apply(t *plainOpts) { t.fallback = float64(o) }
+func (o plain0x20) apply(t *plainOpts)     { t.x20 = true }
+func (o plainLatency) apply(t *plainOpts)  { t.latency = true }
+func (o plainTCP) apply(t *plainOpts)      { t.tcp = true }
+func (o plainRand) apply(t *plainOpts)     { t.rand = RandSource(o) }
+func (o plainMaxQueue) apply(t *plainOpts) { t.maxQueue = int(o) }
+func (o plainEDNS) apply(t *plainOpts)     { t.edns = uint16(o) }
+func (o plainCD) apply(t *plainOpts)       { t.cd = true }
+
+// PlainCache adds caching to the resolver, with the given options.
+func PlainCache(options ...CacheOption) PlainOption { return plainCache(options) }
+
+// PlainDialFunc sets the DialFunc used by the resolver.
+// By default [net.Dialer.DialContext] is used.
+func PlainDialFunc(f DialFunc) PlainOption { return plainDialFunc(f) }
+
+// PlainCookies enables DNS cookies (RFC 7873), which protect against off-path spoofing.
+// Responses that don't echo the client cookie are rejected;
+// server cookies are remembered for each server address.
+func PlainCookies() PlainOption { return plainCookies{} }
+
+// PlainRetryOnServfail sets how many times a query that fails with SERVFAIL
+// is retried on the next server, with exponential backoff; the default is 1.
+// Queries are retried at most once on each server.
+func PlainRetryOnServfail(n int) PlainOption { return plainServfail(n) }
+
+// PlainTCPFallback sets the fraction (between 0 and 1) of the time left until the query deadline
+// to wait for a response over UDP, before also sending the query over TCP,
+// and using whichever response arrives first; if UDP fails sooner, TCP is tried right away.
+// Without a deadline, the fraction applies to the 5 second default timeout of the Go resolver.
+// This recovers from UDP packet loss, or firewalls that drop UDP.
+// By default, queries are sent over TCP only for truncated responses.
+func PlainTCPFallback(fraction float64) PlainOption { return plainFallback(fraction) }
+
+// Plain0x20 randomizes the case of names in queries (DNS 0x20), which protects against off-path spoofing.
+// Responses that don't echo the exact case are rejected;
+// some servers normalize the case of names, and fail with this option.
+// Cached answers are unaffected, as cache keys ignore case.
+func Plain0x20() PlainOption { return plain0x20{} }
+
+// PlainLatencyAware selects the fastest server for each query, instead of failing over in order.
+// Latency is a moving average of the round-trip time of queries to each server.
+// Servers that fail are avoided until all of them have failed.
+func PlainLatencyAware() PlainOption { return plainLatency{} }
+
+// PlainForceTCP sends every query over TCP, instead of UDP,
+// which avoids fragmentation and off-path spoofing, at the cost of latency.
+// It overrides [PlainTCPFallback].
+func PlainForceTCP() PlainOption { return plainTCP{} }
+
+// PlainRand sets the source of randomness used for [PlainCookies] and [Plain0x20], see [RandSource].
+// Both protect against spoofing only if the source is unpredictable.
+func PlainRand(f RandSource) PlainOption { return plainRand(f) }
+
+// PlainMaxQueue sets the maximum size, in bytes, of the queries queued on a connection to the resolver,
+// before they're sent; writes over it fail.
+// By default, the queue fits a full [ExchangeBatch] of maximum size queries.
+func PlainMaxQueue(size int) PlainOption { return plainMaxQueue(size) }
+
+// PlainEDNSBufSize rewrites outgoing queries to advertise the given EDNS UDP payload size,
+// like [EDNSBufSize], without requiring [PlainCache].
+// If zero, [DefaultEDNSBufSize] is used.
+func PlainEDNSBufSize(size uint16) PlainOption {
+	if size == 0 {
+		size = DefaultEDNSBufSize
+	}
+	return plainEDNS(size)
+}
+
+// PlainCheckingDisabled rewrites outgoing queries to set the Checking Disabled (CD) bit,
+// like [CheckingDisabled], without requiring [PlainCache].
+func PlainCheckingDisabled() PlainOption { return plainCD{} }
+
+var errCaseMismatch = errors.New("dns: response question case mismatch")
+
+const (
+	rcodeServFail = 2 // SERVFAIL RCODE
+	plainBackoff  = 50 * time.Millisecond
+	plainTimeout  = 5 * time.Second // the default of the Go resolver
+)
+
+func truncated(res string) bool {
+	return len(res) >= 12 && res[2]&0x02 != 0
+}
+
+func checkSocket(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.New("not a socket")
+	}
+	return nil
+}
+
+// fallbackDelay returns the fraction of the time left until the deadline of ctx.
+func fallbackDelay(ctx context.Context, fraction float64) time.Duration {
+	timeout := plainTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	return time.Duration(float64(timeout) * fraction)
+}
+
+// fallback calls primary, and also secondary if primary fails, or doesn't complete within delay,
+// returning the first successful response.
+func fallback(ctx context.Context, delay time.Duration, primary, secondary func(context.Context) (string, error)) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		res string
+		err error
+	}
+	results := make(chan result, 2)
+	run := func(f func(context.Context) (string, error)) {
+		go func() {
+			res, err := f(ctx)
+			results <- result{res, err}
+		}()
+	}
+
+	run(primary)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	started := false
+	for pending := 1; ; {
+		select {
+		case <-timer.C:
+			if !started {
+				started = true
+				run(secondary)
+				pending++
+			}
+		case r := <-results:
+			if r.err == nil {
+				return r.res, nil
+			}
+			pending--
+			if !started {
+				// don't wait for the delay
+				started = true
+				run(secondary)
+				pending++
+			}
+			if pending == 0 {
+				return "", r.err
+			}
+		}
+	}
+}
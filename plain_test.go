@@ -0,0 +1,577 @@
+package dns_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/ncruces/go-dns"
+)
+
+func TestNewPlainResolver(t *testing.T) {
+	addr := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	// the first server refuses connections
+	r, err := dns.NewPlainResolver([]string{"127.0.0.1:1", addr})
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+		return
+	}
+
+	ips, err := r.LookupIP(context.TODO(), "ip4", "example.com.")
+	if err != nil {
+		t.Fatalf("LookupIP('example.com.') error = %v", err)
+	}
+	if len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Errorf("LookupIP('example.com.') = %v", ips)
+	}
+}
+
+func TestNewPlainResolver_truncated(t *testing.T) {
+	addr := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		res := answer(req, 60)
+		res.RCode = dnsmessage.RCodeSuccess
+		res.Truncated = true
+		return res
+	})
+
+	var tcp atomic.Int32
+	dial := pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+		tcp.Add(1)
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	r, err := dns.NewPlainResolver([]string{addr},
+		dns.PlainDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			if network == "tcp" {
+				return dial(ctx, network, address)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}),
+		dns.PlainCache())
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+		return
+	}
+
+	for i := 0; i < 2; i++ {
+		ips, err := r.LookupIP(context.TODO(), "ip4", "example.com.")
+		if err != nil {
+			t.Fatalf("LookupIP('example.com.') error = %v", err)
+		}
+		if len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+			t.Errorf("LookupIP('example.com.') = %v", ips)
+		}
+	}
+	if n := tcp.Load(); n != 1 {
+		t.Errorf("got %d TCP queries, wanted 1", n)
+	}
+}
+
+func TestNewPlainResolver_local(t *testing.T) {
+	zone := newTestZone()
+	zone.addHost("example.com.", "192.0.2.1", "2001:db8::1")
+	zone.setRCode("servfail.test.", dnsmessage.RCodeServerFailure)
+	zone.setTruncated("large.test.")
+	addr := udpServer(t, zone.handler)
+
+	// TCP answers truncated names
+	dial := pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.2")
+	})
+
+	r, err := dns.NewPlainResolver([]string{addr},
+		dns.PlainDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			if network == "tcp" {
+				return dial(ctx, network, address)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}))
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, name := range []string{"nxdomain.test", "servfail.test"} {
+		if e, err := r.LookupIPAddr(ctx, name); err == nil {
+			t.Errorf("LookupIPAddr(%q) = %v", name, e)
+		}
+	}
+	if ips, err := r.LookupIPAddr(ctx, "example.com"); err != nil || !checkIPAddrs(ips, "192.0.2.1", "2001:db8::1") {
+		t.Errorf("LookupIPAddr('example.com') = %v, %v", ips, err)
+	}
+	if ips, err := r.LookupIPAddr(ctx, "large.test"); err != nil || !checkIPAddrs(ips, "192.0.2.2") {
+		t.Errorf("LookupIPAddr('large.test') = %v, %v", ips, err)
+	}
+}
+
+func TestNewPlainResolver_invalid(t *testing.T) {
+	if _, err := dns.NewPlainResolver(nil); err == nil {
+		t.Error("NewPlainResolver(nil) succeeded")
+	}
+	if _, err := dns.NewPlainResolver([]string{"localhost"}); err == nil {
+		t.Error("NewPlainResolver('localhost') succeeded")
+	}
+}
+
+func TestNewPlainResolver_unix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dns.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip("Unix domain sockets not supported.")
+	}
+	defer ln.Close()
+
+	// proxy connections to an in memory server
+	dial := pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			pipe, _ := dial(context.TODO(), "tcp", "")
+			go io.Copy(pipe, conn)
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, pipe)
+			}()
+		}
+	}()
+
+	r, err := dns.NewPlainResolver([]string{"unix:" + path})
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+		return
+	}
+
+	ips, err := r.LookupIP(context.TODO(), "ip4", "example.com.")
+	if err != nil {
+		t.Fatalf("LookupIP('example.com.') error = %v", err)
+	}
+	if len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+		t.Errorf("LookupIP('example.com.') = %v", ips)
+	}
+
+	// missing sockets, and other files, are rejected
+	for _, path := range []string{filepath.Join(dir, "missing.sock"), dir} {
+		if _, err := dns.NewPlainResolver([]string{"unix:" + path}); err == nil {
+			t.Errorf("NewPlainResolver('unix:%s') succeeded", path)
+		}
+	}
+}
+
+func TestPlainCookies(t *testing.T) {
+	const server = "SRVCOOKI"
+
+	var spoof atomic.Bool
+	cookies := make(chan string, 4)
+	addr := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		res := answer(req, 60, "192.0.2.1")
+		for _, rr := range req.Additionals {
+			opt, ok := rr.Body.(*dnsmessage.OPTResource)
+			if !ok {
+				continue
+			}
+			for _, o := range opt.Options {
+				if o.Code != 10 {
+					continue
+				}
+				select {
+				case cookies <- string(o.Data):
+				default:
+				}
+				client := string(o.Data[:8])
+				if spoof.Load() {
+					client = "SPOOFED!"
+				}
+				res.Additionals = append(res.Additionals, dnsmessage.Resource{
+					Header: rr.Header,
+					Body: &dnsmessage.OPTResource{Options: []dnsmessage.Option{
+						{Code: 10, Data: []byte(client + server)},
+					}},
+				})
+			}
+		}
+		return res
+	})
+
+	r, err := dns.NewPlainResolver([]string{addr}, dns.PlainCookies())
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+		return
+	}
+
+	lookup := func() error {
+		_, err := r.LookupIP(context.TODO(), "ip4", "example.com.")
+		return err
+	}
+
+	if err := lookup(); err != nil {
+		t.Fatalf("LookupIP('example.com.') error = %v", err)
+	}
+	first := <-cookies
+	if len(first) != 8 {
+		t.Fatalf("got cookie %q, wanted a client cookie", first)
+	}
+
+	// the server cookie is sent back
+	if err := lookup(); err != nil {
+		t.Fatalf("LookupIP('example.com.') error = %v", err)
+	}
+	if got := <-cookies; got != first+server {
+		t.Errorf("got cookie %q, wanted %q", got, first+server)
+	}
+
+	// spoofed responses are rejected
+	spoof.Store(true)
+	if err := lookup(); err == nil {
+		t.Error("LookupIP('example.com.') with spoofed cookie succeeded")
+	}
+}
+
+func TestPlainRetryOnServfail(t *testing.T) {
+	var failures, answers atomic.Int32
+	failing := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		failures.Add(1)
+		res := answer(req, 60)
+		res.RCode = dnsmessage.RCodeServerFailure
+		return res
+	})
+	working := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		answers.Add(1)
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	tests := []struct {
+		name     string
+		options  []dns.PlainOption
+		servers  []string
+		want     dnsmessage.RCode
+		failures int32
+	}{
+		{"Default", nil, []string{failing, working}, dnsmessage.RCodeSuccess, 1},
+		{"Disabled", []dns.PlainOption{dns.PlainRetryOnServfail(0)}, []string{failing, working}, dnsmessage.RCodeServerFailure, 1},
+		{"AllFailing", []dns.PlainOption{dns.PlainRetryOnServfail(5)}, []string{failing, failing}, dnsmessage.RCodeServerFailure, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failures.Store(0)
+			r, err := dns.NewPlainResolver(tt.servers, tt.options...)
+			if err != nil {
+				t.Fatalf("NewPlainResolver(...) error = %v", err)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			res, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA))
+			if err != nil {
+				t.Fatalf("Exchange(...) error = %v", err)
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(res); err != nil {
+				t.Fatalf("Unpack(...) error = %v", err)
+			}
+			if msg.RCode != tt.want {
+				t.Errorf("got RCODE %v, wanted %v", msg.RCode, tt.want)
+			}
+			if n := failures.Load(); n != tt.failures {
+				t.Errorf("got %d failures, wanted %d", n, tt.failures)
+			}
+		})
+	}
+}
+
+func TestPlainLatencyAware(t *testing.T) {
+	var slowQueries atomic.Int32
+	slow := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		slowQueries.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return answer(req, 60, "192.0.2.1")
+	})
+	fast := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	r, err := dns.NewPlainResolver([]string{slow, fast}, dns.PlainLatencyAware())
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 10; i++ {
+		if _, err := dns.Exchange(ctx, r, newQuery(t, uint16(i), "example.com.", dnsmessage.TypeA)); err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+	}
+	if n := slowQueries.Load(); n != 1 {
+		t.Errorf("got %d queries to the slow server, wanted 1", n)
+	}
+}
+
+func TestPlainTCPFallback(t *testing.T) {
+	// a TCP server, and a UDP server that drops queries, on the same port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	udp, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		t.Skip("UDP port not available.")
+	}
+	defer udp.Close()
+
+	dial := pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			pipe, _ := dial(context.TODO(), "tcp", "")
+			go io.Copy(pipe, conn)
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, pipe)
+			}()
+		}
+	}()
+
+	tests := []struct {
+		name    string
+		options []dns.PlainOption
+		wantErr bool
+	}{
+		{"Default", nil, true},
+		{"Fallback", []dns.PlainOption{dns.PlainTCPFallback(0.1)}, false},
+		{"ForceTCP", []dns.PlainOption{dns.PlainForceTCP()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := dns.NewPlainResolver([]string{ln.Addr().String()}, tt.options...)
+			if err != nil {
+				t.Fatalf("NewPlainResolver(...) error = %v", err)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			_, err = dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Exchange(...) error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPlainTCPFallback_udpError(t *testing.T) {
+	// a TCP server, and no UDP server, on the same port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	dial := pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			pipe, _ := dial(context.TODO(), "tcp", "")
+			go io.Copy(pipe, conn)
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, pipe)
+			}()
+		}
+	}()
+
+	var network atomic.Value
+	r, err := dns.NewPlainResolver([]string{ln.Addr().String()},
+		dns.PlainTCPFallback(0.9),
+		dns.PlainDialFunc(func(ctx context.Context, n, address string) (net.Conn, error) {
+			if n == "udp" {
+				return nil, errors.New("unreachable")
+			}
+			network.Store(n)
+			var d net.Dialer
+			return d.DialContext(ctx, n, address)
+		}))
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// UDP fails right away, so TCP doesn't wait for most of the deadline
+	start := time.Now()
+	if _, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA)); err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Exchange(...) took %v", d)
+	}
+	if n := network.Load(); n != "tcp" {
+		t.Errorf("answered over %v, wanted tcp", n)
+	}
+}
+
+func TestPlain0x20(t *testing.T) {
+	var randomized atomic.Bool
+	echo := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		if name := req.Questions[0].Name.String(); name != "example.com." {
+			randomized.Store(true)
+		}
+		return answer(req, 60, "192.0.2.1")
+	})
+	normalize := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		res := answer(req, 60, "192.0.2.1")
+		res.Questions = []dnsmessage.Question{req.Questions[0]}
+		res.Questions[0].Name = dnsmessage.MustNewName(strings.ToLower(req.Questions[0].Name.String()))
+		return res
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := dns.NewPlainResolver([]string{echo}, dns.Plain0x20())
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+		return
+	}
+	for i := 0; i < 5; i++ {
+		res, err := dns.Exchange(ctx, r, newQuery(t, uint16(i), "example.com.", dnsmessage.TypeA))
+		if err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+		// the question is echoed as asked
+		var msg dnsmessage.Message
+		if err := msg.Unpack(res); err != nil {
+			t.Fatalf("Unpack(...) error = %v", err)
+		}
+		if got := msg.Questions[0].Name.String(); got != "example.com." {
+			t.Errorf("Exchange(...) question = %q", got)
+		}
+	}
+	if !randomized.Load() {
+		t.Error("query case not randomized")
+	}
+
+	r, err = dns.NewPlainResolver([]string{normalize}, dns.Plain0x20())
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+		return
+	}
+	for i := 0; i < 5; i++ {
+		// all lowercase is a valid echo
+		if _, err := dns.Exchange(ctx, r, newQuery(t, uint16(i), "example.com.", dnsmessage.TypeA)); err != nil {
+			return
+		}
+	}
+	t.Error("Exchange(...) with normalized case succeeded")
+}
+
+func TestPlainRand(t *testing.T) {
+	var names []string
+	var mtx sync.Mutex
+	srv := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		mtx.Lock()
+		names = append(names, req.Questions[0].Name.String())
+		mtx.Unlock()
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	// flip the case of every letter
+	r, err := dns.NewPlainResolver([]string{srv}, dns.Plain0x20(),
+		dns.PlainRand(func() uint64 { return math.MaxUint64 }))
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		if _, err := dns.Exchange(ctx, r, newQuery(t, uint16(i), "example.com.", dnsmessage.TypeA)); err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if want := []string{"EXAMPLE.COM.", "EXAMPLE.COM."}; !check(names, want) {
+		t.Errorf("got questions %v, wanted %v", names, want)
+	}
+}
+
+func TestPlainCheckingDisabled(t *testing.T) {
+	var cd atomic.Bool
+	var size atomic.Int32
+	srv := udpServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		cd.Store(req.CheckingDisabled)
+		size.Store(-1)
+		for _, rr := range req.Additionals {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				size.Store(int32(rr.Header.Class))
+			}
+		}
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	r, err := dns.NewPlainResolver([]string{srv}, dns.PlainCheckingDisabled(), dns.PlainEDNSBufSize(4096))
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// this query has no OPT record
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	if _, err := dns.Exchange(ctx, r, query); err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+	if !cd.Load() {
+		t.Error("query sent without the CD bit")
+	}
+	if n := size.Load(); n != 4096 {
+		t.Errorf("got EDNS buffer size %d, wanted 4096", n)
+	}
+}
@@ -0,0 +1,36 @@
+package dns
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+)
+
+// A RandSource returns uniformly distributed random 64-bit values,
+// and must be safe for concurrent use.
+//
+// By default, resolvers read from crypto/rand, as randomness protects
+// DNS cookies and DNS 0x20 against spoofing. A deterministic source can be useful for testing;
+// see [CacheRand], [PlainRand], [DoTRand] and [DoHRand].
+type RandSource func() uint64
+
+// A randFunc returns uniformly distributed random 64-bit values.
+type randFunc func() uint64
+
+// cryptoRand is the default randFunc, reading from crypto/rand.
+func cryptoRand() uint64 {
+	var buf [8]byte
+	if _, err := crand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// float64 returns a random number in [0.0,1.0).
+func (f randFunc) float64() float64 {
+	return float64(f()>>11) / (1 << 53)
+}
+
+// intn returns a random number in [0,n).
+func (f randFunc) intn(n int) int {
+	return int(f() % uint64(n))
+}
@@ -0,0 +1,310 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A Resolver is a [net.Resolver] that holds resources,
+// like idle connections, that can be released by closing it.
+type Resolver struct {
+	*net.Resolver
+	close func()
+	stats *resolverStats
+	addrs *addrList
+	conf  ResolverConfig
+}
+
+type resolverStats struct {
+	queries atomic.Uint64
+	lastErr atomic.Pointer[error]
+}
+
+// Close closes idle connections and stops any background work.
+// Lookups using a closed resolver fail.
+func (r *Resolver) Close() error {
+	r.close()
+	return nil
+}
+
+// QueryCount returns the number of queries made using the resolver,
+// including those answered from the cache.
+func (r *Resolver) QueryCount() uint64 {
+	return r.stats.queries.Load()
+}
+
+// LastError returns the last error connecting to, or exchanging messages with, the resolver.
+func (r *Resolver) LastError() error {
+	if err := r.stats.lastErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// Upstreams returns the network addresses of the resolver, with their latency and health.
+// Addresses not yet resolved, see [DoTLazyBootstrap], are not reported.
+func (r *Resolver) Upstreams() []UpstreamStats {
+	return r.addrs.stats()
+}
+
+// Config returns the effective configuration of the resolver, computed when it was created:
+// its server, the network addresses it uses, the TLS server name, and the cache options applied.
+// Addresses not yet resolved, see [DoTLazyBootstrap], are not reported.
+// Options that a [ResolverConfig] can't describe are omitted.
+func (r *Resolver) Config() ResolverConfig {
+	config := r.conf
+	config.Addresses = append([]string(nil), config.Addresses...)
+	if config.Cache != nil {
+		cache := *config.Cache
+		cache.Types = append([]dnsmessage.Type(nil), cache.Types...)
+		config.Cache = &cache
+	}
+	return config
+}
+
+func newResolver(resolver *net.Resolver, addrs *addrList, close func()) *Resolver {
+	ctx, cancel := context.WithCancel(context.Background())
+	stats := &resolverStats{}
+
+	dial := resolver.Dial
+	resolver.Dial = func(dctx context.Context, network, address string) (net.Conn, error) {
+		if ctx.Err() != nil {
+			return nil, net.ErrClosed
+		}
+		conn, err := dial(withLifetime(dctx, ctx), network, address)
+		if err != nil {
+			stats.failed(err)
+			return nil, err
+		}
+		return &statsConn{Conn: conn, stats: stats}, nil
+	}
+
+	return &Resolver{
+		Resolver: resolver,
+		stats:    stats,
+		addrs:    addrs,
+		close: func() {
+			cancel()
+			if close != nil {
+				close()
+			}
+		},
+	}
+}
+
+func (s *resolverStats) failed(err error) {
+	s.lastErr.Store(&err)
+}
+
+// statsConn counts queries, which are sent with a single write,
+// and records errors.
+type statsConn struct {
+	net.Conn
+	stats *resolverStats
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.stats.failed(err)
+	}
+	return n, err
+}
+
+func (c *statsConn) Write(b []byte) (int, error) {
+	c.stats.queries.Add(1)
+	n, err := c.Conn.Write(b)
+	if err != nil {
+		c.stats.failed(err)
+	}
+	return n, err
+}
+
+// NewHTTPTransport creates an [http.Transport], like [http.DefaultTransport],
+// that uses resolver to resolve host names before dialing.
+// When both IPv4 and IPv6 addresses are returned, they're raced with Happy Eyeballs (RFC 6555).
+func NewHTTPTransport(resolver *net.Resolver) *http.Transport {
+	d := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  resolver,
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = d.DialContext
+	return t
+}
+
+// A RoundTripFunc sends a DNS query message, and returns the response.
+type RoundTripFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+// NewResolverFromRoundTripper creates a [net.Resolver] that uses f to send queries.
+// This can be used to implement custom transports,
+// or to answer queries with canned responses in tests.
+func NewResolverFromRoundTripper(f RoundTripFunc) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn := &dnsConn{}
+			conn.roundTrip = func(ctx context.Context, req string) (string, error) {
+				res, err := f(ctx, []byte(req))
+				return string(res), err
+			}
+			return conn, nil
+		},
+	}
+}
+
+// NewRacingResolver creates a [net.Resolver] that sends each query to all resolvers concurrently,
+// and uses the first positive response, one with answers, canceling the others.
+// Negative responses, name errors (NXDOMAIN) and responses with no answers (NODATA),
+// are used only if no resolver answers positively, after all of them respond,
+// so racing takes as long as the slowest resolver for names that don't exist.
+//
+// The resolvers must have a Dial function, like those created by this package, see [Exchange].
+func NewRacingResolver(resolvers ...*net.Resolver) *net.Resolver {
+	return NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		type result struct {
+			res []byte
+			err error
+		}
+		results := make(chan result, len(resolvers))
+		for _, r := range resolvers {
+			go func(r *net.Resolver) {
+				res, err := Exchange(ctx, r, query)
+				results <- result{res, err}
+			}(r)
+		}
+
+		var fallback []byte
+		var err error = errNoDial
+		for range resolvers {
+			r := <-results
+			switch {
+			case r.err != nil:
+				err = r.err
+			case len(r.res) >= 12 && r.res[3]&0xf == 0 && (r.res[6] != 0 || r.res[7] != 0):
+				return r.res, nil
+			case fallback == nil:
+				fallback = r.res
+			}
+		}
+		if fallback != nil {
+			return fallback, nil
+		}
+		return nil, err
+	})
+}
+
+// NewRoutingResolver creates a [net.Resolver] that sends each query to one of transports,
+// selected with [WithTransport], or to the primary transport, by default.
+// This allows sending sensitive lookups over a different transport, like DNS over TLS,
+// while using DNS over HTTPS for the rest.
+//
+// The resolvers must have a Dial function, like those created by this package, see [Exchange].
+func NewRoutingResolver(primary string, transports map[string]*net.Resolver) (*net.Resolver, error) {
+	routes := make(map[string]*net.Resolver, len(transports))
+	for name, r := range transports {
+		routes[name] = r
+	}
+	if routes[primary] == nil {
+		return nil, fmt.Errorf("dns: unknown transport %q", primary)
+	}
+
+	return &net.Resolver{
+		PreferGo:     true,
+		StrictErrors: routes[primary].StrictErrors,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			name, ok := ctx.Value(transportKey{}).(string)
+			if !ok {
+				name = primary
+			}
+			r := routes[name]
+			if r == nil {
+				return nil, fmt.Errorf("dns: unknown transport %q", name)
+			}
+			if r.Dial == nil {
+				return nil, errNoDial
+			}
+			return r.Dial(ctx, network, address)
+		},
+	}, nil
+}
+
+// WithTransport returns a copy of ctx that makes lookups using a resolver
+// created with [NewRoutingResolver] use the named transport.
+// Lookups fail if the resolver has no such transport.
+func WithTransport(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, transportKey{}, name)
+}
+
+type transportKey struct{}
+
+// withLifetime returns a copy of ctx that carries life, the lifetime of a resolver,
+// so that background work started by lookups stops when the resolver is closed.
+func withLifetime(ctx, life context.Context) context.Context {
+	return context.WithValue(ctx, lifetimeKey{}, life)
+}
+
+type lifetimeKey struct{}
+
+func lifetime(ctx context.Context) context.Context {
+	if life, ok := ctx.Value(lifetimeKey{}).(context.Context); ok {
+		return life
+	}
+	return context.Background()
+}
+
+// NewResolverWithHosts creates a [net.Resolver] that answers A and AAAA queries for the names in hosts
+// with the given addresses, like a hosts file, and sends other queries to parent.
+// This pins names, like those of internal services, while using encrypted DNS for the rest.
+// Names are case-insensitive; for a mapped name, queries for a missing address family get empty answers.
+//
+// The parent must have a Dial function, like those created by this package, see [Exchange].
+func NewResolverWithHosts(hosts map[string][]net.IP, parent *net.Resolver) *net.Resolver {
+	pinned := make(map[string][]net.IP, len(hosts))
+	for name, ips := range hosts {
+		name = strings.ToLower(name)
+		if !strings.HasSuffix(name, ".") {
+			name += "."
+		}
+		pinned[name] = append(pinned[name], ips...)
+	}
+
+	return NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		var p dnsmessage.Parser
+		if _, err := p.Start(query); err == nil {
+			q, err := p.Question()
+			if err == nil && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA) {
+				if ips, ok := pinned[strings.ToLower(q.Name.String())]; ok {
+					return BuildResponse(query, dnsmessage.RCodeSuccess, hostsAnswers(q, ips)...)
+				}
+			}
+		}
+		return Exchange(ctx, parent, query)
+	})
+}
+
+func hostsAnswers(q dnsmessage.Question, ips []net.IP) []dnsmessage.Resource {
+	var answers []dnsmessage.Resource
+	hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			answers = append(answers, dnsmessage.Resource{Header: hdr,
+				Body: &dnsmessage.AResource{A: *(*[4]byte)(ip4)}})
+		} else if ip4 == nil && len(ip) == net.IPv6len && q.Type == dnsmessage.TypeAAAA {
+			answers = append(answers, dnsmessage.Resource{Header: hdr,
+				Body: &dnsmessage.AAAAResource{AAAA: *(*[16]byte)(ip)}})
+		}
+	}
+	return answers
+}
@@ -0,0 +1,513 @@
+package dns_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/ncruces/go-dns"
+)
+
+func TestResolver_Close(t *testing.T) {
+	r, err := dns.NewDoHResolverWithClose("https://dns.google/dns-query",
+		dns.DoHAddresses("127.0.0.1:1"))
+	if err != nil {
+		t.Fatalf("NewDoHResolverWithClose(...) error = %v", err)
+		return
+	}
+
+	err = r.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	_, err = dns.Exchange(context.TODO(), r.Resolver, query)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Exchange(...) on closed resolver error = %v", err)
+	}
+}
+
+func TestResolver_Close_refresh(t *testing.T) {
+	addr, config := dotServer(t, func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	})
+
+	var dials, late atomic.Int32
+	var closed atomic.Bool
+	hold := make(chan struct{})
+	r, err := dns.NewDoTResolverWithClose("example.com",
+		dns.DoTAddresses(addr),
+		dns.DoTConfig(config),
+		dns.DoTCache(dns.MaxCacheTTL(time.Millisecond), dns.CacheGrace(time.Hour)),
+		dns.DoTDialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			if dials.Add(1) > 1 {
+				<-hold // hold the refresh
+			}
+			if closed.Load() && ctx.Err() == nil {
+				late.Add(1)
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}))
+	if err != nil {
+		t.Fatalf("NewDoTResolverWithClose(...) error = %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	for i := 0; i < 2; i++ {
+		if _, err := dns.Exchange(ctx, r.Resolver, query); err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for dials.Load() < 2 && ctx.Err() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the pending refresh is canceled
+	r.Close()
+	closed.Store(true)
+	close(hold)
+	time.Sleep(10 * time.Millisecond)
+
+	if n := late.Load(); n != 0 {
+		t.Errorf("got %d dials after Close", n)
+	}
+}
+
+func TestResolver_QueryCount(t *testing.T) {
+	srv := httptest.NewServer(dohHandler(func(req dnsmessage.Message) dnsmessage.Message {
+		return answer(req, 60, "192.0.2.1")
+	}))
+	defer srv.Close()
+
+	r, err := dns.NewDoHResolverWithClose(srv.URL,
+		dns.DoHAddresses(srv.Listener.Addr().String()),
+		dns.DoHAllowInsecureScheme())
+	if err != nil {
+		t.Fatalf("NewDoHResolverWithClose(...) error = %v", err)
+		return
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	for i := 0; i < 2; i++ {
+		if _, err := dns.Exchange(ctx, r.Resolver, query); err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+	}
+	if n := r.QueryCount(); n != 2 {
+		t.Errorf("QueryCount() = %d, wanted 2", n)
+	}
+	if err := r.LastError(); err != nil {
+		t.Errorf("LastError() = %v", err)
+	}
+
+	srv.Close()
+	if _, err := dns.Exchange(ctx, r.Resolver, query); err == nil {
+		t.Fatal("Exchange(...) with closed server succeeded")
+	}
+	if n := r.QueryCount(); n != 3 {
+		t.Errorf("QueryCount() = %d, wanted 3", n)
+	}
+	if err := r.LastError(); err == nil {
+		t.Error("LastError() = nil")
+	}
+}
+
+func ExampleNewResolverFromRoundTripper() {
+	resolver := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		var p dnsmessage.Parser
+		if _, err := p.Start(query); err != nil {
+			return nil, err
+		}
+		q, err := p.Question()
+		if err != nil {
+			return nil, err
+		}
+		if q.Type != dnsmessage.TypeA {
+			return dns.BuildResponse(query, dnsmessage.RCodeSuccess)
+		}
+		return dns.BuildResponse(query, dnsmessage.RCodeSuccess, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		})
+	})
+
+	ips, _ := resolver.LookupIP(context.TODO(), "ip4", "example.com.")
+	for _, ip := range ips {
+		fmt.Println(ip)
+	}
+
+	// Output:
+	// 192.0.2.1
+}
+
+func TestNewRacingResolver(t *testing.T) {
+	slow := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return dns.BuildResponse(query, dnsmessage.RCodeSuccess, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  dnsmessage.MustNewName("example.com."),
+				Type:  dnsmessage.TypeA,
+				Class: dnsmessage.ClassINET,
+				TTL:   60,
+			},
+			Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		})
+	})
+	nxdomain := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		return dns.BuildResponse(query, dnsmessage.RCodeNameError)
+	})
+	nodata := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		return dns.BuildResponse(query, dnsmessage.RCodeSuccess)
+	})
+	failing := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		return nil, errors.New("unreachable")
+	})
+
+	// the slower success wins
+	for _, r := range []*net.Resolver{
+		dns.NewRacingResolver(nxdomain, failing, slow),
+		dns.NewRacingResolver(nodata, failing, slow),
+	} {
+		ips, err := r.LookupIP(context.TODO(), "ip4", "example.com.")
+		if err != nil {
+			t.Fatalf("LookupIP('example.com.') error = %v", err)
+		}
+		if len(ips) != 1 || ips[0].String() != "192.0.2.1" {
+			t.Errorf("LookupIP('example.com.') = %v", ips)
+		}
+	}
+
+	// the name error is used if nothing succeeds
+	r := dns.NewRacingResolver(failing, nxdomain)
+	_, err := r.LookupIP(context.TODO(), "ip4", "example.com.")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupIP('example.com.') error = %v", err)
+	}
+}
+
+func TestNewRoutingResolver(t *testing.T) {
+	transport := func(a byte) *net.Resolver {
+		return dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+			return dns.BuildResponse(query, dnsmessage.RCodeSuccess, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{
+					Name:  dnsmessage.MustNewName("example.com."),
+					Type:  dnsmessage.TypeA,
+					Class: dnsmessage.ClassINET,
+					TTL:   60,
+				},
+				Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, a}},
+			})
+		})
+	}
+	transports := map[string]*net.Resolver{
+		"doh": transport(1),
+		"dot": transport(2),
+	}
+
+	if _, err := dns.NewRoutingResolver("plain", transports); err == nil {
+		t.Error("NewRoutingResolver(...) with unknown primary succeeded")
+	}
+
+	r, err := dns.NewRoutingResolver("doh", transports)
+	if err != nil {
+		t.Fatalf("NewRoutingResolver(...) error = %v", err)
+	}
+
+	tests := []struct {
+		ctx  context.Context
+		want string
+	}{
+		{context.Background(), "192.0.2.1"},
+		{dns.WithTransport(context.Background(), "doh"), "192.0.2.1"},
+		{dns.WithTransport(context.Background(), "dot"), "192.0.2.2"},
+	}
+	for _, tt := range tests {
+		ips, err := r.LookupIP(tt.ctx, "ip4", "example.com.")
+		if err != nil {
+			t.Fatalf("LookupIP('example.com.') error = %v", err)
+		}
+		if len(ips) != 1 || ips[0].String() != tt.want {
+			t.Errorf("LookupIP('example.com.') = %v, wanted %v", ips, tt.want)
+		}
+	}
+
+	ctx := dns.WithTransport(context.Background(), "plain")
+	if ips, err := r.LookupIP(ctx, "ip4", "example.com."); err == nil {
+		t.Errorf("LookupIP('example.com.') with unknown transport = %v", ips)
+	}
+}
+
+func TestNewHTTPTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+
+	var resolved atomic.Bool
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			if req.Questions[0].Name.String() == "example.test." {
+				resolved.Store(true)
+			}
+			return answer(req, 60, "127.0.0.1")
+		}),
+	}
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	client := http.Client{Transport: dns.NewHTTPTransport(r)}
+	res, err := client.Get("http://example.test:" + port)
+	if err != nil {
+		t.Fatalf("Get(...) error = %v", err)
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(res.Body)
+	if got := string(body); got != "example.test:"+port {
+		t.Errorf("got Host %q", got)
+	}
+	if !resolved.Load() {
+		t.Error("example.test not resolved")
+	}
+}
+
+func TestResolver_streamOnly(t *testing.T) {
+	pipe := func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+	dot, err := dns.NewDoTResolver("dns.example",
+		dns.DoTAddresses("192.0.2.1"),
+		dns.DoTDialFunc(pipe))
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+	}
+	doh, err := dns.NewDoHResolverWithClose("https://dns.example/dns-query",
+		dns.DoHAddresses("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("NewDoHResolverWithClose(...) error = %v", err)
+	}
+	plain, err := dns.NewPlainResolver([]string{"192.0.2.1"})
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+	}
+	custom := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		return nil, errors.New("unreachable")
+	})
+
+	// messages are always framed with a length prefix
+	resolvers := map[string]*net.Resolver{
+		"DoT":     dot,
+		"DoH":     doh.Resolver,
+		"Plain":   plain,
+		"Custom":  custom,
+		"Caching": dns.NewCachingResolver(custom),
+	}
+	for name, r := range resolvers {
+		for _, network := range []string{"udp", "tcp"} {
+			conn, err := r.Dial(context.TODO(), network, "192.0.2.1:53")
+			if err != nil {
+				t.Fatalf("%s: Dial(%q) error = %v", name, network, err)
+			}
+			if _, ok := conn.(net.PacketConn); ok {
+				t.Errorf("%s: Dial(%q) returned a net.PacketConn", name, network)
+			}
+			conn.Close()
+		}
+	}
+}
+
+func TestResolver_idMismatch(t *testing.T) {
+	r := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		var req dnsmessage.Message
+		if err := req.Unpack(query); err != nil {
+			return nil, err
+		}
+		res := answer(req, 60, "192.0.2.1")
+		res.ID++
+		return res.Pack()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for name, r := range map[string]*net.Resolver{
+		"Custom":  r,
+		"Caching": dns.NewCachingResolver(r),
+	} {
+		if res, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA)); err == nil {
+			t.Errorf("%s: Exchange(...) = %q, wanted error", name, res)
+		}
+		if ips, err := r.LookupIPAddr(ctx, "example.com"); err == nil {
+			t.Errorf("%s: LookupIPAddr(...) = %v, wanted error", name, ips)
+		}
+	}
+}
+
+func TestResolver_queueFull(t *testing.T) {
+	r := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		return nil, errors.New("unreachable")
+	})
+
+	conn, err := r.Dial(context.TODO(), "tcp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatalf("Dial(...) error = %v", err)
+	}
+	defer conn.Close()
+
+	// queries are queued until read, up to a bound
+	msg := make([]byte, 2+0xffff)
+	msg[0], msg[1] = 0xff, 0xff
+	for i := 0; ; i++ {
+		if _, err := conn.Write(msg); err != nil {
+			break
+		}
+		if i > 1000 {
+			t.Fatal("Write(...) queue is unbounded")
+		}
+	}
+}
+
+func TestResolver_maxQueue(t *testing.T) {
+	plain, err := dns.NewPlainResolver([]string{"192.0.2.1"}, dns.PlainMaxQueue(1000))
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+	}
+	cached, err := dns.NewPlainResolver([]string{"192.0.2.1"}, dns.PlainMaxQueue(1000), dns.PlainCache())
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+	}
+	doh, err := dns.NewDoHResolver("https://dns.example/dns-query",
+		dns.DoHAddresses("192.0.2.1"), dns.DoHMaxQueue(1000))
+	if err != nil {
+		t.Fatalf("NewDoHResolver(...) error = %v", err)
+	}
+	dot, err := dns.NewDoTResolver("dns.example",
+		dns.DoTAddresses("192.0.2.1"), dns.DoTMaxQueue(1000), dns.DoTCache())
+	if err != nil {
+		t.Fatalf("NewDoTResolver(...) error = %v", err)
+	}
+
+	for name, r := range map[string]*net.Resolver{
+		"Plain": plain, "PlainCache": cached, "DoH": doh, "DoTCache": dot,
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := r.Dial(context.TODO(), "tcp", "192.0.2.1:53")
+			if err != nil {
+				t.Fatalf("Dial(...) error = %v", err)
+			}
+			defer conn.Close()
+
+			// queries are queued until read, up to the bound
+			msg := make([]byte, 2+500)
+			msg[0], msg[1] = 0x01, 0xf4
+			if _, err := conn.Write(msg); err != nil {
+				t.Fatalf("Write(...) error = %v", err)
+			}
+			if _, err := conn.Write(msg); err == nil {
+				t.Error("Write(...) over the bound succeeded")
+			}
+		})
+	}
+}
+
+func TestResolver_noData(t *testing.T) {
+	// NODATA responses without the RA bit, for names with only IPv4 addresses
+	r := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		var req dnsmessage.Message
+		if err := req.Unpack(query); err != nil {
+			return nil, err
+		}
+		q := req.Questions[0]
+		res := answer(req, 60, "192.0.2.1")
+		if q.Type == dnsmessage.TypeAAAA {
+			res.RCode = dnsmessage.RCodeSuccess
+			res.RecursionAvailable = false
+			res.Authorities = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSOA, Class: q.Class, TTL: 60},
+				Body: &dnsmessage.SOAResource{
+					NS:     dnsmessage.MustNewName("ns.example.com."),
+					MBox:   dnsmessage.MustNewName("hostmaster.example.com."),
+					MinTTL: 60,
+				},
+			}}
+		}
+		return res.Pack()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := r.LookupIP(ctx, "ip6", "example.com")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("LookupIP('ip6', ...) error = %v, wanted not found", err)
+	}
+	if ips, err := r.LookupIPAddr(ctx, "example.com"); err != nil || !checkIPAddrs(ips, "192.0.2.1") {
+		t.Errorf("LookupIPAddr(...) = %v, %v", ips, err)
+	}
+}
+
+func TestNewResolverWithHosts(t *testing.T) {
+	var queries atomic.Int32
+	parent := &net.Resolver{
+		PreferGo: true,
+		Dial: pipeDial(func(req dnsmessage.Message) dnsmessage.Message {
+			queries.Add(1)
+			return answer(req, 60, "192.0.2.1")
+		}),
+	}
+	r := dns.NewResolverWithHosts(map[string][]net.IP{
+		"Internal.Example": {net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")},
+		"v4only.example.":  {net.ParseIP("10.0.0.2")},
+	}, parent)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if ips, err := r.LookupIPAddr(ctx, "internal.example"); err != nil || !checkIPAddrs(ips, "10.0.0.1", "fd00::1") {
+		t.Errorf("LookupIPAddr('internal.example') = %v, %v", ips, err)
+	}
+	if ips, err := r.LookupIPAddr(ctx, "v4only.example"); err != nil || !checkIPAddrs(ips, "10.0.0.2") {
+		t.Errorf("LookupIPAddr('v4only.example') = %v, %v", ips, err)
+	}
+	if ips, err := r.LookupIP(ctx, "ip6", "v4only.example"); err == nil {
+		t.Errorf("LookupIP('ip6', 'v4only.example') = %v", ips)
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("got %d queries, wanted 0", n)
+	}
+
+	if ips, err := r.LookupIPAddr(ctx, "example.com"); err != nil || !checkIPAddrs(ips, "192.0.2.1") {
+		t.Errorf("LookupIPAddr('example.com') = %v, %v", ips, err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("got %d queries, wanted 2", n)
+	}
+}
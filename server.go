@@ -0,0 +1,269 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A Server is a DNS server that answers queries over UDP and TCP
+// by forwarding them to a resolver, like a local stub resolver.
+// Combined with a caching DNS over TLS or HTTPS resolver,
+// this makes an encrypted DNS proxy for the whole system.
+type Server struct {
+	Addr       string        // the UDP and TCP address to listen on, ":53" if empty
+	Resolver   *net.Resolver // forwards queries; must have a Dial function, see [Exchange]
+	Timeout    time.Duration // bounds each query; the default is 5 seconds
+	MaxQueries int           // bounds queries in flight; the default is 1000
+
+	mtx       sync.Mutex
+	listeners []interface{ Close() error }
+	closed    bool
+	sem       chan struct{}
+}
+
+// ListenAndServe listens on addr over UDP and TCP,
+// and answers queries by forwarding them to resolver.
+// See [Server.ListenAndServe].
+func ListenAndServe(addr string, resolver *net.Resolver) error {
+	s := &Server{Addr: addr, Resolver: resolver}
+	return s.ListenAndServe()
+}
+
+// ListenAndServe listens on s.Addr over UDP and TCP, and serves queries.
+// It returns when either listener fails, closing the other,
+// or after s is closed, with an error wrapping [net.ErrClosed].
+func (s *Server) ListenAndServe() error {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":53"
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- s.ServePacket(pc) }()
+	go func() { errs <- s.Serve(ln) }()
+	err = <-errs
+	pc.Close()
+	ln.Close()
+	<-errs
+	return err
+}
+
+// ServePacket serves queries received on the packet connection pc, like a UDP socket.
+// Responses that don't fit the payload size advertised by the client
+// (512 bytes, without EDNS) are truncated, so the client retries over TCP.
+// Queries over s.MaxQueries are dropped.
+func (s *Server) ServePacket(pc net.PacketConn) error {
+	s.track(pc)
+	defer pc.Close()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n < 12 { // header size
+			continue
+		}
+		if !s.acquire() {
+			continue
+		}
+		req := string(buf[:n])
+		go func() {
+			defer s.release()
+			res := s.exchange(req)
+			if res == "" {
+				return
+			}
+			if len(res) > udpPayloadSize(req) {
+				res = truncate(res)
+			}
+			pc.WriteTo([]byte(res), addr)
+		}()
+	}
+}
+
+// Serve serves queries received on connections accepted by ln, like a TCP listener.
+// Queries are framed like TCP, and may be pipelined;
+// responses are sent as they arrive, out of order.
+// Queries over s.MaxQueries are answered with SERVFAIL.
+func (s *Server) Serve(ln net.Listener) error {
+	s.track(ln)
+	defer ln.Close()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close closes all listeners, making Serve, ServePacket, and ListenAndServe return.
+// Queries in flight are not interrupted.
+// Listeners served after Close are closed immediately.
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = nil
+	s.closed = true
+	return nil
+}
+
+func (s *Server) track(l interface{ Close() error }) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		l.Close()
+		return
+	}
+	s.listeners = append(s.listeners, l)
+}
+
+// acquire reserves a slot for a query in flight,
+// and reports whether one was available.
+func (s *Server) acquire() bool {
+	s.mtx.Lock()
+	if s.sem == nil {
+		n := s.MaxQueries
+		if n <= 0 {
+			n = serverMaxQueries
+		}
+		s.sem = make(chan struct{}, n)
+	}
+	sem := s.sem
+	s.mtx.Unlock()
+
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) release() { <-s.sem }
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	var mtx sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		// idle connections are closed (RFC 7766)
+		conn.SetReadDeadline(time.Now().Add(serverIdleTimeout))
+		req, err := readMessage(conn)
+		if err != nil {
+			return
+		}
+		if len(req) < 12 { // header size
+			return
+		}
+
+		if !s.acquire() {
+			if res := servfail(req); res != "" {
+				mtx.Lock()
+				writeMessage(conn, res)
+				mtx.Unlock()
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.release()
+			if res := s.exchange(req); res != "" {
+				mtx.Lock()
+				defer mtx.Unlock()
+				writeMessage(conn, res)
+			}
+		}()
+	}
+}
+
+// exchange forwards req to the resolver,
+// answering SERVFAIL if that fails.
+func (s *Server) exchange(req string) string {
+	if req[2] >= 0x80 { // not a query
+		return ""
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = serverTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	res, err := Exchange(ctx, s.Resolver, []byte(req))
+	if err == nil {
+		return string(res)
+	}
+	return servfail(req)
+}
+
+// servfail answers req with SERVFAIL.
+func servfail(req string) string {
+	if req[2] >= 0x80 { // not a query
+		return ""
+	}
+	res, err := BuildResponse([]byte(req), dnsmessage.RCodeServerFailure)
+	if err != nil {
+		return ""
+	}
+	return string(res)
+}
+
+const (
+	serverTimeout     = 5 * time.Second
+	serverIdleTimeout = 10 * time.Second
+	serverMaxQueries  = 1000
+)
+
+// udpPayloadSize returns the maximum size of a UDP response to req.
+func udpPayloadSize(req string) int {
+	if opt, _, ok := findOPT(req); ok && opt >= 0 {
+		// the CLASS field holds the payload size
+		if size := getUint16(req[opt+2:]); size > 512 {
+			return size
+		}
+	}
+	return 512
+}
+
+// truncate returns the header and questions of res, with the TC bit set.
+// Unparseable messages are reduced to their header.
+func truncate(res string) string {
+	qdcount := getUint16(res[4:])
+	i := 12 // skip header
+	for n := 0; n < qdcount; n++ {
+		name := getNameLen(res[i:])
+		if name < 0 || i+name+4 > len(res) {
+			qdcount, i = 0, 12
+			break
+		}
+		i += name + 4
+	}
+	return res[:2] + string([]byte{res[2] | 0x02, res[3],
+		byte(qdcount >> 8), byte(qdcount), 0, 0, 0, 0, 0, 0}) + res[12:i]
+}
@@ -0,0 +1,229 @@
+package dns_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/ncruces/go-dns"
+)
+
+func TestServer(t *testing.T) {
+	zone := newTestZone()
+	zone.addHost("example.com.", "192.0.2.1", "2001:db8::1")
+	var big []string
+	for i := 0; i < 100; i++ {
+		big = append(big, fmt.Sprintf("192.0.2.%d", i+1))
+	}
+	zone.addHost("big.example.com.", big...)
+	upstream := &net.Resolver{PreferGo: true, Dial: pipeDial(zone.handler)}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &dns.Server{Resolver: upstream}
+	errs := make(chan error, 2)
+	go func() { errs <- srv.ServePacket(pc) }()
+	go func() { errs <- srv.Serve(ln) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := dns.NewPlainResolver([]string{pc.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+	}
+
+	ips, err := r.LookupIPAddr(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("LookupIPAddr('example.com') error = %v", err)
+	}
+	if !checkIPAddrs(ips, "192.0.2.1", "2001:db8::1") {
+		t.Errorf("LookupIPAddr('example.com') = %v", ips)
+	}
+
+	// truncated over UDP, retried over TCP
+	ips, err = r.LookupIPAddr(ctx, "big.example.com")
+	if err != nil {
+		t.Fatalf("LookupIPAddr('big.example.com') error = %v", err)
+	}
+	if !checkIPAddrs(ips, big...) {
+		t.Errorf("LookupIPAddr('big.example.com') = %v", ips)
+	}
+
+	// errors
+	if _, err := r.LookupIPAddr(ctx, "nxdomain.example.com"); err == nil {
+		t.Error("LookupIPAddr('nxdomain.example.com') succeeded")
+	}
+
+	// pipelined over TCP
+	tcp := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", ln.Addr().String())
+		},
+	}
+	queries := make([][]byte, 10)
+	for i := range queries {
+		queries[i] = newQuery(t, uint16(i+1), "example.com.", dnsmessage.TypeA)
+	}
+	responses, err := dns.ExchangeBatch(ctx, tcp, queries)
+	if err != nil {
+		t.Fatalf("ExchangeBatch(...) error = %v", err)
+	}
+	for i, res := range responses {
+		var msg dnsmessage.Message
+		if err := msg.Unpack(res); err != nil || msg.ID != uint16(i+1) || len(msg.Answers) != 1 {
+			t.Errorf("ExchangeBatch(...)[%d] = %v, %v", i, msg, err)
+		}
+	}
+
+	srv.Close()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Serve(...) error = %v", err)
+		}
+	}
+}
+
+func TestServer_servfail(t *testing.T) {
+	failing := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		return nil, errors.New("unreachable")
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Resolver: failing}
+	defer srv.Close()
+	go srv.ServePacket(pc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := dns.NewPlainResolver([]string{pc.LocalAddr().String()}, dns.PlainRetryOnServfail(0))
+	if err != nil {
+		t.Fatalf("NewPlainResolver(...) error = %v", err)
+	}
+	res, err := dns.Exchange(ctx, r, newQuery(t, 1, "example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatalf("Exchange(...) error = %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(res); err != nil {
+		t.Fatalf("Unpack(...) error = %v", err)
+	}
+	if msg.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("got RCODE %v", msg.RCode)
+	}
+}
+
+func TestServer_maxQueries(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	blocking := dns.NewResolverFromRoundTripper(func(ctx context.Context, query []byte) ([]byte, error) {
+		started <- struct{}{}
+		<-release
+		return dns.BuildResponse(query, dnsmessage.RCodeSuccess)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Resolver: blocking, MaxQueries: 1}
+	defer srv.Close()
+	go srv.ServePacket(pc)
+	go srv.Serve(ln)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// a UDP query takes the only slot
+	udp, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	if _, err := udp.Write(newQuery(t, 1, "example.com.", dnsmessage.TypeA)); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	tcp := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", ln.Addr().String())
+		},
+	}
+	rcode := func() dnsmessage.RCode {
+		t.Helper()
+		res, err := dns.Exchange(ctx, tcp, newQuery(t, 2, "example.com.", dnsmessage.TypeA))
+		if err != nil {
+			t.Fatalf("Exchange(...) error = %v", err)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(res); err != nil {
+			t.Fatalf("Unpack(...) error = %v", err)
+		}
+		return msg.RCode
+	}
+
+	// queries over the limit fail
+	if got := rcode(); got != dnsmessage.RCodeServerFailure {
+		t.Errorf("got RCODE %v, wanted SERVFAIL", got)
+	}
+
+	// the slot is freed once answered
+	close(release)
+	buf := make([]byte, 512)
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := udp.Read(buf); err != nil {
+		t.Fatalf("Read(...) error = %v", err)
+	}
+	for rcode() != dnsmessage.RCodeSuccess {
+		if ctx.Err() != nil {
+			t.Fatal("slot never freed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServer_closed(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// listeners served after Close are closed
+	srv := &dns.Server{}
+	srv.Close()
+	if err := srv.ServePacket(pc); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ServePacket(...) error = %v", err)
+	}
+	if err := srv.Serve(ln); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve(...) error = %v", err)
+	}
+}